@@ -0,0 +1,96 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+var (
+	_, ipv4privateA, _ = net.ParseCIDR("10.0.0.0/8")
+	_, ipv4privateB, _ = net.ParseCIDR("172.16.0.0/12")
+	_, ipv4privateC, _ = net.ParseCIDR("192.168.0.0/16")
+	_, ipv4shared, _   = net.ParseCIDR("100.64.0.0/10")
+	_, ipv6unique, _   = net.ParseCIDR("fc00::/7")
+)
+
+// interfaceAddr is an address of a network interface with the properties
+// relevant for publishing it.
+type interfaceAddr struct {
+	ip         net.IP
+	temporary  bool
+	deprecated bool
+	tentative  bool
+	stable     bool
+	preferred  uint32
+}
+
+// isGlobalAddress checks if ip is reachable from the Internet.
+func isGlobalAddress(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+	for _, network := range []*net.IPNet{ipv4privateA, ipv4privateB, ipv4privateC, ipv4shared, ipv6unique} {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// interfaceAddress returns the address of the given family to publish for the
+// named interface. Temporary, deprecated, tentative and non-global addresses
+// are never used. Stable addresses are preferred over others, then addresses
+// with the longest preferred lifetime.
+func interfaceAddress(name, family string) (net.IP, error) {
+	addrs, err := interfaceAddrs(name)
+	if err != nil {
+		return nil, err
+	}
+	best := bestAddress(addrs, family)
+	if best == nil {
+		return nil, fmt.Errorf("no usable %s address on interface %s", family, name)
+	}
+	return best.ip, nil
+}
+
+// bestAddress returns the address of the given family to publish from addrs,
+// or nil if none is usable.
+func bestAddress(addrs []*interfaceAddr, family string) *interfaceAddr {
+	var best *interfaceAddr
+	for _, addr := range addrs {
+		if (addr.ip.To4() != nil) != (family == familyIPv4) {
+			continue
+		}
+		if addr.temporary || addr.deprecated || addr.tentative || !isGlobalAddress(addr.ip) {
+			continue
+		}
+		switch {
+		case best == nil:
+		case addr.stable && !best.stable:
+		case addr.stable == best.stable && addr.preferred > best.preferred:
+		default:
+			continue
+		}
+		best = addr
+	}
+	return best
+}
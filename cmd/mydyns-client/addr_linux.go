@@ -0,0 +1,153 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Netlink constants, which are not defined in the syscall package.
+const (
+	rtmgrpIPv4IfAddr     = 0x10
+	rtmgrpIPv6IfAddr     = 0x100
+	ifaFlags             = 0x8
+	ifaFManageTempAddr   = 0x100
+	ifaCacheinfoPrefered = 0
+)
+
+// interfaceAddrs returns the addresses of the named interface including their
+// flags, as reported by netlink.
+func interfaceAddrs(name string) ([]*interfaceAddr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, os.NewSyscallError("netlinkrib", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, os.NewSyscallError("parsenetlinkmessage", err)
+	}
+
+	var addrs []*interfaceAddr
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		ifam := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		if int(ifam.Index) != iface.Index {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, os.NewSyscallError("parsenetlinkrouteattr", err)
+		}
+
+		addr := &interfaceAddr{
+			preferred: ^uint32(0),
+		}
+		flags := uint32(ifam.Flags)
+		var local, address net.IP
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFA_LOCAL:
+				local = net.IP(a.Value)
+			case syscall.IFA_ADDRESS:
+				address = net.IP(a.Value)
+			case ifaFlags:
+				if len(a.Value) >= 4 {
+					flags = *(*uint32)(unsafe.Pointer(&a.Value[0]))
+				}
+			case syscall.IFA_CACHEINFO:
+				if len(a.Value) >= 4 {
+					addr.preferred = *(*uint32)(unsafe.Pointer(&a.Value[ifaCacheinfoPrefered]))
+				}
+			}
+		}
+		// For point to point links, IFA_LOCAL is the local address.
+		addr.ip = address
+		if local != nil {
+			addr.ip = local
+		}
+		if addr.ip == nil {
+			continue
+		}
+		if ifam.Family == syscall.AF_INET6 {
+			addr.temporary = flags&syscall.IFA_F_TEMPORARY != 0
+		}
+		addr.deprecated = flags&syscall.IFA_F_DEPRECATED != 0 || addr.preferred == 0
+		addr.tentative = flags&(syscall.IFA_F_TENTATIVE|syscall.IFA_F_DADFAILED) != 0
+		addr.stable = flags&(syscall.IFA_F_PERMANENT|ifaFManageTempAddr) != 0
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+// watchAddresses sends to changed whenever an address of any interface was
+// added or removed, as reported by netlink.
+func watchAddresses(changed chan<- bool) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return os.NewSyscallError("bind", err)
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, os.Getpagesize()*4)
+		for {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == syscall.EINTR || err == syscall.ENOBUFS {
+					// Messages were lost, better check again.
+					notifyChanged(changed)
+					continue
+				}
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				if m.Header.Type == syscall.RTM_NEWADDR || m.Header.Type == syscall.RTM_DELADDR {
+					notifyChanged(changed)
+					break
+				}
+			}
+		}
+	}()
+
+	return nil
+}
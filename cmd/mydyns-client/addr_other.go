@@ -1,3 +1,6 @@
+//go:build !linux
+// +build !linux
+
 /*
 Mydyns - run your own dynamic DNS zone
 Copyright (C) 2015  Simon Eisenmann
@@ -20,54 +23,34 @@ with this program; if not, write to the Free Software Foundation, Inc.,
 package main
 
 import (
-	"encoding/csv"
-	"log"
-	"os"
-	"strings"
+	"errors"
+	"net"
 )
 
-type HostsFile struct {
-	hosts map[string][]string
-}
-
-func NewHostsFile(fn string) (*HostsFile, error) {
-	f, err := os.Open(fn)
+// interfaceAddrs returns the addresses of the named interface. Address flags
+// are not available on this platform, so temporary and deprecated addresses
+// cannot be recognized.
+func interfaceAddrs(name string) ([]*interfaceAddr, error) {
+	iface, err := net.InterfaceByName(name)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	// hosts files are essentially csv files.
-	reader := csv.NewReader(f)
-	reader.Comma = ':'
-	reader.Comment = '#'
-	reader.TrimLeadingSpace = true
-
-	entries, err := reader.ReadAll()
+	ifaddrs, err := iface.Addrs()
 	if err != nil {
 		return nil, err
 	}
-
-	h := &HostsFile{
-		hosts: make(map[string][]string),
-	}
-	for _, entry := range entries {
-		h.hosts[entry[0]] = strings.Split(entry[1], ",")
+	var addrs []*interfaceAddr
+	for _, ifaddr := range ifaddrs {
+		if ipnet, ok := ifaddr.(*net.IPNet); ok {
+			addrs = append(addrs, &interfaceAddr{
+				ip: ipnet.IP,
+			})
+		}
 	}
-
-	log.Printf("Loaded %d hosts\n", len(h.hosts))
-	return h, nil
+	return addrs, nil
 }
 
-func (h *HostsFile) CheckUser(host, user string) bool {
-	entry, ok := h.hosts[host]
-	if !ok {
-		return false
-	}
-	for _, u := range entry {
-		if u == user {
-			return true
-		}
-	}
-	return false
+// watchAddresses is not supported on this platform.
+func watchAddresses(changed chan<- bool) error {
+	return errors.New("address change notifications are not supported on this platform")
 }
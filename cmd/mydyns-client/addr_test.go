@@ -0,0 +1,93 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsGlobalAddress(t *testing.T) {
+	tests := []struct {
+		ip     string
+		global bool
+	}{
+		{"203.0.113.5", true},
+		{"2001:db8::1", true},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"127.0.0.1", false},
+		{"169.254.1.1", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"ff02::1", false},
+	}
+	for _, test := range tests {
+		if global := isGlobalAddress(net.ParseIP(test.ip)); global != test.global {
+			t.Errorf("isGlobalAddress(%s) = %v, want %v", test.ip, global, test.global)
+		}
+	}
+}
+
+func TestBestAddress(t *testing.T) {
+	addr := func(ip string) *interfaceAddr {
+		return &interfaceAddr{ip: net.ParseIP(ip)}
+	}
+	tests := []struct {
+		name     string
+		addrs    []*interfaceAddr
+		family   string
+		expected string
+	}{
+		{"ipv4", []*interfaceAddr{addr("2001:db8::1"), addr("192.168.1.2"), addr("203.0.113.5")}, familyIPv4, "203.0.113.5"},
+		{"ipv6", []*interfaceAddr{addr("fe80::1"), addr("203.0.113.5"), addr("2001:db8::1")}, familyIPv6, "2001:db8::1"},
+		{"none", []*interfaceAddr{addr("fe80::1"), addr("fd00::1")}, familyIPv6, ""},
+		{"skipped", []*interfaceAddr{
+			{ip: net.ParseIP("2001:db8::1"), temporary: true},
+			{ip: net.ParseIP("2001:db8::2"), deprecated: true},
+			{ip: net.ParseIP("2001:db8::3"), tentative: true},
+			{ip: net.ParseIP("2001:db8::4"), preferred: 10},
+		}, familyIPv6, "2001:db8::4"},
+		{"stable", []*interfaceAddr{
+			{ip: net.ParseIP("2001:db8::1"), preferred: 3600},
+			{ip: net.ParseIP("2001:db8::2"), stable: true, preferred: 60},
+			{ip: net.ParseIP("2001:db8::3"), preferred: 7200},
+		}, familyIPv6, "2001:db8::2"},
+		{"longest lifetime", []*interfaceAddr{
+			{ip: net.ParseIP("2001:db8::1"), preferred: 3600},
+			{ip: net.ParseIP("2001:db8::2"), preferred: 7200},
+			{ip: net.ParseIP("2001:db8::3"), preferred: 60},
+		}, familyIPv6, "2001:db8::2"},
+	}
+	for _, test := range tests {
+		best := bestAddress(test.addrs, test.family)
+		if test.expected == "" {
+			if best != nil {
+				t.Errorf("%s: got %s, want none", test.name, best.ip)
+			}
+		} else if best == nil || best.ip.String() != test.expected {
+			t.Errorf("%s: got %v, want %s", test.name, best, test.expected)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Address families.
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// Client talks to the mydynsd HTTP API.
+type Client struct {
+	server *url.URL
+	http   map[string]*http.Client
+}
+
+func NewClient(config *Config) (*Client, error) {
+	server, err := url.Parse(config.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.CA != "" {
+		pem, err := ioutil.ReadFile(config.CA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	c := &Client{
+		server: server,
+		http:   make(map[string]*http.Client),
+	}
+	// Clients which only connect with one address family, so the server sees
+	// the address of that family.
+	for family, network := range map[string]string{
+		"":         "tcp",
+		familyIPv4: "tcp4",
+		familyIPv6: "tcp6",
+	} {
+		dialer := &net.Dialer{
+			Timeout: config.Timeout,
+		}
+		network := network
+		c.http[family] = &http.Client{
+			Timeout: config.Timeout,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, addr)
+				},
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: config.Timeout,
+			},
+		}
+	}
+	return c, nil
+}
+
+// request sends a request to the update endpoint and returns the response
+// body.
+func (c *Client) request(ctx context.Context, family string, params url.Values) (string, error) {
+	u := *c.server
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/update"
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := c.http[family].Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	result := strings.TrimSpace(string(body))
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned %s: %s", response.Status, result)
+	}
+	return result, nil
+}
+
+// Check returns the address of the given family as seen by the server.
+func (c *Client) Check(ctx context.Context, family, token string) (net.IP, error) {
+	result, err := c.request(ctx, family, url.Values{
+		"token": {token},
+		"check": {""},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(result)
+	if ip == nil {
+		return nil, fmt.Errorf("server returned invalid address: %s", result)
+	}
+	if (ip.To4() != nil) != (family == familyIPv4) {
+		return nil, fmt.Errorf("server returned address of wrong family: %s", ip)
+	}
+	return ip, nil
+}
+
+// Update publishes ip for the hosts of token. Tokens for several hosts
+// return a result line for each host.
+func (c *Client) Update(ctx context.Context, token string, ip net.IP) error {
+	result, err := c.request(ctx, "", url.Values{
+		"token": {token},
+		"myip":  {ip.String()},
+	})
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(result, "\n") {
+		if line != "accepted" && !strings.HasSuffix(line, ": accepted") {
+			return errors.New(line)
+		}
+	}
+	return nil
+}
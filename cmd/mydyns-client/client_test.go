@@ -0,0 +1,104 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	var query string
+	response := ""
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mydyns/update" {
+			http.NotFound(w, r)
+			return
+		}
+		query = r.URL.RawQuery
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(&Config{Server: server.URL + "/mydyns/", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	updates := []struct {
+		name     string
+		status   int
+		response string
+		err      bool
+	}{
+		{"accepted", http.StatusOK, "accepted\n", false},
+		{"several hosts", http.StatusOK, "home: accepted\noffice: accepted\n", false},
+		{"partly failed", http.StatusOK, "home: accepted\noffice: forbidden\n", true},
+		{"failed", http.StatusForbidden, "forbidden\n", true},
+	}
+	for _, test := range updates {
+		status, response = test.status, test.response
+		err := client.Update(ctx, "token", net.ParseIP("203.0.113.5"))
+		if test.err && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		} else if !test.err && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+	if query != "myip=203.0.113.5&token=token" {
+		t.Errorf("unexpected update query %q", query)
+	}
+
+	checks := []struct {
+		name     string
+		response string
+		err      bool
+	}{
+		{"address", "203.0.113.5\n", false},
+		{"invalid", "accepted\n", true},
+		{"wrong family", "2001:db8::1\n", true},
+	}
+	status = http.StatusOK
+	for _, test := range checks {
+		response = test.response
+		ip, err := client.Check(ctx, familyIPv4, "token")
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !ip.Equal(net.ParseIP("203.0.113.5")) {
+			t.Errorf("%s: got %s", test.name, ip)
+		}
+	}
+	if query != "check=&token=token" {
+		t.Errorf("unexpected check query %q", query)
+	}
+}
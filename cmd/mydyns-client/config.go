@@ -0,0 +1,149 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Detection modes for addresses.
+const (
+	detectNone      = "none"
+	detectServer    = "server"
+	detectInterface = "interface"
+)
+
+// Config defines the client configuration.
+type Config struct {
+	Server   string        `yaml:"server"`
+	CA       string        `yaml:"ca"`
+	Interval time.Duration `yaml:"interval"`
+	Refresh  time.Duration `yaml:"refresh"`
+	Retry    time.Duration `yaml:"retry"`
+	Timeout  time.Duration `yaml:"timeout"`
+	State    string        `yaml:"state"`
+	Hosts    []*HostConfig `yaml:"hosts"`
+}
+
+// HostConfig defines a host to keep updated.
+type HostConfig struct {
+	Name      string `yaml:"name"`
+	Token     string `yaml:"token"`
+	IPv4      string `yaml:"ipv4"`
+	IPv6      string `yaml:"ipv6"`
+	Interface string `yaml:"interface"`
+}
+
+func NewConfig(fn string) (*Config, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{
+		Interval: 5 * time.Minute,
+		Refresh:  24 * time.Hour,
+		Retry:    15 * time.Second,
+		Timeout:  30 * time.Second,
+		State:    "/var/lib/mydyns-client/state.json",
+	}
+	if err = yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	if err = config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return config, nil
+}
+
+func (config *Config) validate() error {
+	u, err := url.Parse(config.Server)
+	if err != nil || u.Host == "" {
+		return errors.New("server must be an URL like https://your.server")
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+		return errors.New("server must use https")
+	}
+	if config.Interval <= 0 || config.Retry <= 0 || config.Timeout <= 0 {
+		return errors.New("interval, retry and timeout must be positive")
+	}
+	if config.State == "" {
+		return errors.New("state file required")
+	}
+	if len(config.Hosts) == 0 {
+		return errors.New("no hosts configured")
+	}
+
+	names := make(map[string]bool)
+	for idx, host := range config.Hosts {
+		if host.Name == "" || host.Token == "" {
+			return fmt.Errorf("host %d: name and token required", idx+1)
+		}
+		if names[host.Name] {
+			return fmt.Errorf("host %s: duplicate name", host.Name)
+		}
+		names[host.Name] = true
+		if host.IPv4 == "" {
+			host.IPv4 = detectServer
+		}
+		if host.IPv6 == "" {
+			// Checks over IPv6 fail on every run for hosts without IPv6
+			// connectivity, so it needs to be enabled.
+			host.IPv6 = detectNone
+		}
+		for _, mode := range []*string{&host.IPv4, &host.IPv6} {
+			switch *mode {
+			case detectNone, detectServer:
+			case detectInterface:
+				if host.Interface == "" {
+					return fmt.Errorf("host %s: interface required for interface detection", host.Name)
+				}
+			default:
+				return fmt.Errorf("host %s: unknown detection mode %s", host.Name, *mode)
+			}
+		}
+	}
+	return nil
+}
+
+// watchInterfaces checks if any host detects addresses from interfaces.
+func (config *Config) watchInterfaces() bool {
+	for _, host := range config.Hosts {
+		if host.IPv4 == detectInterface || host.IPv6 == detectInterface {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopback checks if host is the local host, where plain http is fine.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
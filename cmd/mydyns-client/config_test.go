@@ -0,0 +1,102 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testHostConfig(ipv4, ipv6, iface string) []*HostConfig {
+	return []*HostConfig{{Name: "home", Token: "token", IPv4: ipv4, IPv6: ipv6, Interface: iface}}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		err    bool
+	}{
+		{"https", Config{Server: "https://dyn.example.com", Hosts: testHostConfig("", "", "")}, false},
+		{"loopback http", Config{Server: "http://127.0.0.1:8040", Hosts: testHostConfig("", "", "")}, false},
+		{"localhost http", Config{Server: "http://localhost:8040", Hosts: testHostConfig("", "", "")}, false},
+		{"interface", Config{Server: "https://dyn.example.com", Hosts: testHostConfig("none", "interface", "eth0")}, false},
+		{"remote http", Config{Server: "http://dyn.example.com", Hosts: testHostConfig("", "", "")}, true},
+		{"no server", Config{Hosts: testHostConfig("", "", "")}, true},
+		{"no hosts", Config{Server: "https://dyn.example.com"}, true},
+		{"no state", Config{Server: "https://dyn.example.com", State: "-", Hosts: testHostConfig("", "", "")}, true},
+		{"no interval", Config{Server: "https://dyn.example.com", Interval: -1, Hosts: testHostConfig("", "", "")}, true},
+		{"no token", Config{Server: "https://dyn.example.com", Hosts: []*HostConfig{{Name: "home"}}}, true},
+		{"duplicate", Config{Server: "https://dyn.example.com", Hosts: append(testHostConfig("", "", ""), testHostConfig("", "", "")...)}, true},
+		{"interface without name", Config{Server: "https://dyn.example.com", Hosts: testHostConfig("interface", "", "")}, true},
+		{"unknown mode", Config{Server: "https://dyn.example.com", Hosts: testHostConfig("dhcp", "", "")}, true},
+	}
+	for _, test := range tests {
+		config := test.config
+		if config.Interval == 0 {
+			config.Interval = time.Minute
+		}
+		config.Retry = time.Second
+		config.Timeout = time.Second
+		if config.State == "" {
+			config.State = "state.json"
+		} else if config.State == "-" {
+			config.State = ""
+		}
+		err := config.validate()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "client.yaml")
+
+	content := "server: https://dyn.example.com\ninterval: 1m\nhosts:\n  - name: home\n    token: secret\n"
+	if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Interval != time.Minute || config.Refresh != 24*time.Hour {
+		t.Errorf("unexpected intervals %s, %s", config.Interval, config.Refresh)
+	}
+	if host := config.Hosts[0]; host.IPv4 != detectServer || host.IPv6 != detectNone {
+		t.Errorf("unexpected detection modes %s, %s", host.IPv4, host.IPv6)
+	}
+
+	if err := ioutil.WriteFile(fn, []byte(content+"unknown: true\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewConfig(fn); err == nil {
+		t.Error("expected error for unknown option")
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v1"
+)
+
+var version = "0.0.1"
+
+// Updater keeps the addresses of all configured hosts updated.
+type Updater struct {
+	config *Config
+	client *Client
+	state  *State
+}
+
+// run updates all hosts once. It returns false if anything failed.
+func (u *Updater) run(ctx context.Context) bool {
+	ok := true
+	for _, host := range u.config.Hosts {
+		for _, family := range []string{familyIPv4, familyIPv6} {
+			if err := u.update(ctx, host, family); err != nil {
+				log.Printf("%s %s update failed: %v\n", host.Name, family, err)
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// update detects the address of family for host and sends it to the server,
+// if it changed or needs to be refreshed.
+func (u *Updater) update(ctx context.Context, host *HostConfig, family string) error {
+	var ip net.IP
+	var err error
+	switch u.mode(host, family) {
+	case detectNone:
+		return nil
+	case detectServer:
+		ip, err = u.client.Check(ctx, family, host.Token)
+	case detectInterface:
+		ip, err = interfaceAddress(host.Interface, family)
+	}
+	if err != nil {
+		return err
+	}
+
+	hs := u.state.Host(host.Name)
+	current, updated := &hs.IPv4, &hs.IPv4Updated
+	if family == familyIPv6 {
+		current, updated = &hs.IPv6, &hs.IPv6Updated
+	}
+	if *current == ip.String() && (u.config.Refresh <= 0 || time.Since(*updated) < u.config.Refresh) {
+		return nil
+	}
+
+	if err = u.client.Update(ctx, host.Token, ip); err != nil {
+		return err
+	}
+	log.Printf("%s %s updated: %s\n", host.Name, family, ip)
+	*current = ip.String()
+	*updated = time.Now()
+	return u.state.Save()
+}
+
+func (u *Updater) mode(host *HostConfig, family string) string {
+	if family == familyIPv6 {
+		return host.IPv6
+	}
+	return host.IPv4
+}
+
+// main is our blocking runner.
+func main() {
+
+	var (
+		configfile = kingpin.Flag("config", "Configuration file.").Default("/etc/mydyns/client.yaml").OverrideDefaultFromEnvar("MYDYNS_CLIENT_CONFIG").PlaceHolder("CONFIGFILE").ExistingFile()
+		once       = kingpin.Flag("once", "Update once and exit, for example when run from cron.").Bool()
+	)
+
+	kingpin.CommandLine.Help = "Keep the addresses of your hosts updated with a mydyns server."
+	kingpin.Version(version)
+	kingpin.Parse()
+
+	config, err := NewConfig(*configfile)
+	if err != nil {
+		log.Fatalf("error reading config: %v", err)
+	}
+	client, err := NewClient(config)
+	if err != nil {
+		log.Fatalf("error creating client: %v", err)
+	}
+	state, err := NewState(config.State)
+	if err != nil {
+		log.Fatalf("error reading state: %v", err)
+	}
+	updater := &Updater{
+		config: config,
+		client: client,
+		state:  state,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	if *once {
+		if !updater.run(ctx) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// React to address changes immediately.
+	changed := make(chan bool, 1)
+	if config.watchInterfaces() {
+		if err = watchAddresses(changed); err != nil {
+			log.Printf("Address changes are only detected every %s: %v\n", config.Interval, err)
+		}
+	}
+
+	log.Printf("Updating %d hosts every %s\n", len(config.Hosts), config.Interval)
+	backoff := config.Retry
+	for {
+		wait := config.Interval
+		if updater.run(ctx) {
+			backoff = config.Retry
+		} else {
+			// Retry failures sooner, with exponential backoff up to the
+			// regular interval and some jitter.
+			wait = backoff + time.Duration(rand.Int63n(int64(backoff)/10+1))
+			if wait > config.Interval {
+				wait = config.Interval
+			}
+			backoff *= 2
+			log.Printf("Retrying in %s\n", wait.Round(time.Second))
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-changed:
+			// Let bursts of changes settle, for example duplicate address
+			// detection of new IPv6 addresses.
+			time.Sleep(2 * time.Second)
+			select {
+			case <-changed:
+			default:
+			}
+			log.Println("Addresses changed")
+		case <-ctx.Done():
+			log.Println("Exiting")
+			return
+		}
+	}
+
+}
+
+// notifyChanged sends to changed without blocking, a pending change is
+// enough.
+func notifyChanged(changed chan<- bool) {
+	select {
+	case changed <- true:
+	default:
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/longsleep/mydyns"
+)
+
+// HostState is the last successfully published state of a host.
+type HostState struct {
+	IPv4        string    `json:"ipv4,omitempty"`
+	IPv4Updated time.Time `json:"ipv4_updated"`
+	IPv6        string    `json:"ipv6,omitempty"`
+	IPv6Updated time.Time `json:"ipv6_updated"`
+}
+
+// State is persisted between runs, so updates are only sent on changes.
+type State struct {
+	fn    string
+	Hosts map[string]*HostState `json:"hosts"`
+}
+
+func NewState(fn string) (*State, error) {
+	state := &State{
+		fn:    fn,
+		Hosts: make(map[string]*HostState),
+	}
+	data, err := ioutil.ReadFile(fn)
+	switch {
+	case os.IsNotExist(err):
+		return state, nil
+	case err != nil:
+		return nil, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Hosts == nil {
+		state.Hosts = make(map[string]*HostState)
+	}
+	return state, nil
+}
+
+// Host returns the state of the host with name, creating it when needed.
+func (state *State) Host(name string) *HostState {
+	hs, ok := state.Hosts[name]
+	if !ok {
+		hs = &HostState{}
+		state.Hosts[name] = hs
+	}
+	return hs
+}
+
+// Save writes the state atomically. It is only readable by the owner.
+func (state *State) Save() error {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(state.fn), 0700); err != nil {
+		return err
+	}
+	return mydyns.WriteFileAtomic(state.fn, data, 0600)
+}
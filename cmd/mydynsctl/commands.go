@@ -0,0 +1,418 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/longsleep/mydyns"
+	"golang.org/x/term"
+)
+
+// Ctl implements the commands of mydynsctl.
+type Ctl struct {
+	files *Files
+}
+
+// errInvalidToken is returned by tokenInspect for tokens which mydynsd would
+// reject.
+var errInvalidToken = errors.New("token is not valid")
+
+// require returns an error if one of the given file locations is not set.
+func (ctl *Ctl) require(names ...string) error {
+	for _, name := range names {
+		var fn string
+		switch name {
+		case "users":
+			fn = ctl.files.Users
+		case "hosts":
+			fn = ctl.files.Hosts
+		case "security":
+			fn = ctl.files.Security
+		case "secret":
+			fn = ctl.files.Secret
+		}
+		if fn == "" {
+			return fmt.Errorf("--%s is required for this command", name)
+		}
+	}
+	return nil
+}
+
+func (ctl *Ctl) userList() error {
+	if err := ctl.require("users", "hosts"); err != nil {
+		return err
+	}
+	users, err := mydyns.NewHtpasswdFile(ctl.files.Users)
+	if err != nil {
+		return err
+	}
+	hosts, err := mydyns.NewHostsFile(ctl.files.Hosts)
+	if err != nil {
+		return err
+	}
+	for _, user := range users.Users() {
+		var granted []string
+		for _, host := range hosts.Hosts() {
+			if hosts.CheckUser(host, user) {
+				granted = append(granted, host)
+			}
+		}
+		status := "enabled"
+		if users.Disabled(user) {
+			status = "disabled"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", user, status, strings.Join(granted, ","), users.Email(user))
+	}
+	return nil
+}
+
+func (ctl *Ctl) userSetPassword(user, password string, create bool) error {
+	if err := ctl.require("users"); err != nil {
+		return err
+	}
+	if !mydyns.ValidEntryValue(user) {
+		return errors.New("invalid user name")
+	}
+	users, err := mydyns.NewHtpasswdFile(ctl.files.Users)
+	if err != nil {
+		return err
+	}
+	switch exists := users.Exists(user); {
+	case create && exists:
+		return fmt.Errorf("user %s already exists", user)
+	case !create && !exists:
+		return fmt.Errorf("user %s not found", user)
+	}
+	if password == "" {
+		if password, err = readPassword(); err != nil {
+			return err
+		}
+	}
+	if err = users.SetPassword(user, password); err != nil {
+		return err
+	}
+	return users.WriteFile(ctl.files.Users)
+}
+
+func (ctl *Ctl) userSetDisabled(user string, disabled bool) error {
+	if err := ctl.require("users"); err != nil {
+		return err
+	}
+	users, err := mydyns.NewHtpasswdFile(ctl.files.Users)
+	if err != nil {
+		return err
+	}
+	if !users.Exists(user) {
+		return fmt.Errorf("user %s not found", user)
+	}
+	users.SetDisabled(user, disabled)
+	return users.WriteFile(ctl.files.Users)
+}
+
+func (ctl *Ctl) userSetEmail(user, email string) error {
+	if err := ctl.require("users"); err != nil {
+		return err
+	}
+	users, err := mydyns.NewHtpasswdFile(ctl.files.Users)
+	if err != nil {
+		return err
+	}
+	if !users.Exists(user) {
+		return fmt.Errorf("user %s not found", user)
+	}
+	if err = users.SetEmail(user, email); err != nil {
+		return err
+	}
+	return users.WriteFile(ctl.files.Users)
+}
+
+func (ctl *Ctl) hostList() error {
+	if err := ctl.require("hosts"); err != nil {
+		return err
+	}
+	hosts, err := mydyns.NewHostsFile(ctl.files.Hosts)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts.Hosts() {
+		entry, _ := hosts.Users(host)
+		fmt.Printf("%s\t%s\t%s\n", mydyns.UnicodeHostname(host), strings.Join(entry, ","), hosts.Options(host))
+	}
+	return nil
+}
+
+func (ctl *Ctl) hostGrant(host, user string) error {
+	if err := ctl.require("users", "hosts"); err != nil {
+		return err
+	}
+	host, err := mydyns.NormalizeHostname(host)
+	if err != nil {
+		return err
+	}
+	users, err := mydyns.NewHtpasswdFile(ctl.files.Users)
+	if err != nil {
+		return err
+	}
+	if !users.Exists(user) {
+		return fmt.Errorf("user %s not found", user)
+	}
+	hosts, err := mydyns.NewHostsFile(ctl.files.Hosts)
+	if err != nil {
+		return err
+	}
+	if hosts.CheckUser(host, user) {
+		return nil
+	}
+	entry, _ := hosts.Users(host)
+	hosts.Set(host, append(entry, user))
+	return hosts.WriteFile(ctl.files.Hosts)
+}
+
+func (ctl *Ctl) hostRevoke(host, user string) error {
+	if err := ctl.require("hosts"); err != nil {
+		return err
+	}
+	hosts, err := mydyns.NewHostsFile(ctl.files.Hosts)
+	if err != nil {
+		return err
+	}
+	if !hosts.CheckUser(host, user) {
+		return fmt.Errorf("user %s is not allowed to update host %s", user, host)
+	}
+	entry, _ := hosts.Users(host)
+	var remaining []string
+	for _, u := range entry {
+		if u != user {
+			remaining = append(remaining, u)
+		}
+	}
+	if len(remaining) > 0 {
+		hosts.Set(host, remaining)
+	} else {
+		hosts.Delete(host)
+	}
+	if err = hosts.Validate(); err != nil {
+		return err
+	}
+	return hosts.WriteFile(ctl.files.Hosts)
+}
+
+func (ctl *Ctl) hostOptions(host, options string) error {
+	if err := ctl.require("hosts"); err != nil {
+		return err
+	}
+	hosts, err := mydyns.NewHostsFile(ctl.files.Hosts)
+	if err != nil {
+		return err
+	}
+	if _, ok := hosts.Users(host); !ok {
+		return fmt.Errorf("host %s not found", host)
+	}
+	if err = hosts.SetOptions(host, options); err != nil {
+		return err
+	}
+	if err = hosts.Validate(); err != nil {
+		return err
+	}
+	return hosts.WriteFile(ctl.files.Hosts)
+}
+
+func (ctl *Ctl) securityRotate(user, code string) error {
+	if err := ctl.require("users", "security"); err != nil {
+		return err
+	}
+	if code == "" {
+		code = mydyns.NewSecurityCode()
+	} else if !mydyns.ValidEntryValue(code) {
+		return errors.New("invalid security code")
+	}
+	users, err := mydyns.NewHtpasswdFile(ctl.files.Users)
+	if err != nil {
+		return err
+	}
+	if !users.Exists(user) {
+		return fmt.Errorf("user %s not found", user)
+	}
+	security, err := mydyns.NewSecurityFile(ctl.files.Security)
+	if err != nil {
+		return err
+	}
+	security.Set(user, code)
+	return security.WriteFile(ctl.files.Security)
+}
+
+func (ctl *Ctl) secretGenerate(fn, size string, force bool) error {
+	if fn == "" {
+		return errors.New("secret file required")
+	}
+	if _, err := os.Stat(fn); err == nil && !force {
+		return fmt.Errorf("%s exists, use --force to replace it and invalidate all tokens", fn)
+	}
+	n, _ := strconv.Atoi(size)
+	secret := make([]byte, n)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	return mydyns.WriteFileAtomic(fn, secret, 0600)
+}
+
+func (ctl *Ctl) tokenCreate(host, user string) error {
+	if err := ctl.require("users", "hosts", "security", "secret"); err != nil {
+		return err
+	}
+	users, err := mydyns.NewHtpasswdFile(ctl.files.Users)
+	if err != nil {
+		return err
+	}
+	if !users.Exists(user) {
+		return fmt.Errorf("user %s does not exist", user)
+	}
+	if users.Disabled(user) {
+		return fmt.Errorf("user %s is disabled", user)
+	}
+	hosts, err := mydyns.NewHostsFile(ctl.files.Hosts)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, name := range strings.Split(host, ",") {
+		name, err = mydyns.NormalizeHostname(name)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		if !hosts.CheckUser(name, user) {
+			return fmt.Errorf("user %s is not allowed to update host %s", user, name)
+		}
+	}
+	security, err := mydyns.NewSecurityFile(ctl.files.Security)
+	if err != nil {
+		return err
+	}
+	secret, err := mydyns.NewSecretFile(ctl.files.Secret)
+	if err != nil {
+		return err
+	}
+
+	data := mydyns.NewTokenData(names, user, security.Secret(user))
+	token, err := secret.Encode(mydyns.TokenName, data)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+func (ctl *Ctl) tokenInspect(token string) error {
+	if err := ctl.require("secret"); err != nil {
+		return err
+	}
+	secret, err := mydyns.NewSecretFile(ctl.files.Secret)
+	if err != nil {
+		return err
+	}
+	var data mydyns.TokenData
+	if err = secret.Decode(mydyns.TokenName, token, &data); err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+	var names []string
+	for _, host := range data.Hostnames() {
+		names = append(names, mydyns.UnicodeHostname(host))
+	}
+	fmt.Printf("Host:\t%s\nUser:\t%s\n", strings.Join(names, ","), data.User)
+
+	// Check the same things as mydynsd does, as far as databases are given.
+	var problems []string
+	if ctl.files.Security != "" {
+		security, err := mydyns.NewSecurityFile(ctl.files.Security)
+		if err != nil {
+			return err
+		}
+		if !security.Check(data.Security, data.User) {
+			problems = append(problems, "security code is outdated")
+		}
+	}
+	if ctl.files.Hosts != "" {
+		hosts, err := mydyns.NewHostsFile(ctl.files.Hosts)
+		if err != nil {
+			return err
+		}
+		for _, host := range data.Hostnames() {
+			if !hosts.CheckUser(host, data.User) {
+				problems = append(problems, fmt.Sprintf("user is not allowed to update host %s", host))
+			}
+		}
+	}
+	if ctl.files.Users != "" {
+		users, err := mydyns.NewHtpasswdFile(ctl.files.Users)
+		if err != nil {
+			return err
+		}
+		if !users.Exists(data.User) {
+			problems = append(problems, "user does not exist")
+		} else if users.Disabled(data.User) {
+			problems = append(problems, "user is disabled")
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("Valid:\tno (%s)\n", strings.Join(problems, ", "))
+		return fmt.Errorf("%w: %s", errInvalidToken, strings.Join(problems, ", "))
+	}
+	fmt.Println("Valid:\tyes")
+	return nil
+}
+
+// readPassword asks for a password on the terminal, or reads a single line
+// from stdin when it is not a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read password: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(repeated) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
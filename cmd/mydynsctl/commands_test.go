@@ -0,0 +1,98 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/longsleep/mydyns"
+)
+
+func testCtl(t *testing.T, users string) *Ctl {
+	dir := t.TempDir()
+	files := &Files{
+		Users:    filepath.Join(dir, "users.db"),
+		Hosts:    filepath.Join(dir, "hosts.db"),
+		Security: filepath.Join(dir, "security.db"),
+		Secret:   filepath.Join(dir, "secret"),
+	}
+	for fn, content := range map[string]string{
+		files.Users:    users,
+		files.Hosts:    "home:alice\n",
+		files.Security: "alice:alicecode\n",
+		files.Secret:   "0123456789abcdef0123456789abcdef",
+	} {
+		if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Ctl{files: files}
+}
+
+func TestTokenCreate(t *testing.T) {
+	tests := []struct {
+		name  string
+		users string
+		user  string
+		ok    bool
+	}{
+		{"enabled", "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", "alice", true},
+		{"disabled", "alice:!{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", "alice", false},
+		{"missing", "bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", "alice", false},
+	}
+	for _, test := range tests {
+		err := testCtl(t, test.users).tokenCreate("home", test.user)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+}
+
+func TestTokenInspect(t *testing.T) {
+	ctl := testCtl(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+	secret, err := mydyns.NewSecretFile(ctl.files.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	security, err := mydyns.NewSecurityFile(ctl.files.Security)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := secret.Encode(mydyns.TokenName, mydyns.NewTokenData([]string{"home"}, "alice", security.Secret("alice")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ctl.tokenInspect(token); err != nil {
+		t.Errorf("valid token: %v", err)
+	}
+	if err = ctl.tokenInspect("invalid"); err == nil || errors.Is(err, errInvalidToken) {
+		t.Errorf("undecodable token should fail with a regular error, got %v", err)
+	}
+	if err = ioutil.WriteFile(ctl.files.Security, []byte("alice:newcode\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ctl.tokenInspect(token); !errors.Is(err, errInvalidToken) {
+		t.Errorf("outdated token should be invalid, got %v", err)
+	}
+}
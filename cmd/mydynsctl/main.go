@@ -0,0 +1,191 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"gopkg.in/alecthomas/kingpin.v1"
+	"gopkg.in/yaml.v2"
+)
+
+var version = "0.0.1"
+
+// Files defines the database and secret files to operate on.
+type Files struct {
+	Users    string `yaml:"users"`
+	Hosts    string `yaml:"hosts"`
+	Security string `yaml:"security"`
+	Secret   string `yaml:"secret"`
+}
+
+// readConfig reads the file locations from a mydynsd configuration file.
+func readConfig(fn string) (*Files, error) {
+	files := &Files{}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, files); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return files, nil
+}
+
+// main is our command runner.
+func main() {
+
+	app := kingpin.New("mydynsctl", "Administrate mydyns users, hosts, security codes and tokens. Database locations are read from the mydynsd configuration file, flags or MYDYNS_* environment variables.")
+	app.Version(version)
+
+	var (
+		configfile   = app.Flag("config", "Configuration file of mydynsd.").OverrideDefaultFromEnvar("MYDYNS_CONFIG").PlaceHolder("CONFIGFILE").String()
+		usersfile    = app.Flag("users", "Htpasswd users database.").OverrideDefaultFromEnvar("MYDYNS_USERS").PlaceHolder("USERSFILE").String()
+		hostsfile    = app.Flag("hosts", "Hosts database.").OverrideDefaultFromEnvar("MYDYNS_HOSTS").PlaceHolder("HOSTSFILE").String()
+		securityfile = app.Flag("security", "Security secret database.").OverrideDefaultFromEnvar("MYDYNS_SECURITY").PlaceHolder("SECURITYFILE").String()
+		secretfile   = app.Flag("secret", "Auth token secret file.").OverrideDefaultFromEnvar("MYDYNS_SECRET").PlaceHolder("SECRETFILE").String()
+		verbose      = app.Flag("verbose", "Show log output.").Short('v').Bool()
+
+		userCmd         = app.Command("user", "Manage users.")
+		userListCmd     = userCmd.Command("list", "List users.")
+		userAddCmd      = userCmd.Command("add", "Create a user.")
+		userAddName     = userAddCmd.Arg("name", "User name.").Required().String()
+		userAddPassword = userAddCmd.Flag("password", "Password, asked for when not given.").String()
+		userPasswdCmd   = userCmd.Command("passwd", "Change the password of a user.")
+		userPasswdName  = userPasswdCmd.Arg("name", "User name.").Required().String()
+		userPasswdValue = userPasswdCmd.Flag("password", "Password, asked for when not given.").String()
+		userDisableCmd  = userCmd.Command("disable", "Disable a user, all password checks fail.")
+		userDisableName = userDisableCmd.Arg("name", "User name.").Required().String()
+		userEnableCmd   = userCmd.Command("enable", "Enable a disabled user.")
+		userEnableName  = userEnableCmd.Arg("name", "User name.").Required().String()
+		userEmailCmd    = userCmd.Command("email", "Set the email address of a user for notifications.")
+		userEmailName   = userEmailCmd.Arg("name", "User name.").Required().String()
+		userEmailValue  = userEmailCmd.Arg("address", "Email address, empty to remove the address.").String()
+
+		hostCmd         = app.Command("host", "Manage hosts.")
+		hostListCmd     = hostCmd.Command("list", "List hosts and their users.")
+		hostGrantCmd    = hostCmd.Command("grant", "Allow a user to update a host, the host is created if needed.")
+		hostGrantHost   = hostGrantCmd.Arg("host", "Host name.").Required().String()
+		hostGrantUser   = hostGrantCmd.Arg("user", "User name.").Required().String()
+		hostRevokeCmd   = hostCmd.Command("revoke", "Remove a user from a host, hosts without users are removed.")
+		hostRevokeHost  = hostRevokeCmd.Arg("host", "Host name.").Required().String()
+		hostRevokeUser  = hostRevokeCmd.Arg("user", "User name.").Required().String()
+		hostOptionsCmd  = hostCmd.Command("options", "Set the options of a host, for example via=router,iid=::1 for IPv6 prefix delegation.")
+		hostOptionsHost = hostOptionsCmd.Arg("host", "Host name.").Required().String()
+		hostOptionsSet  = hostOptionsCmd.Arg("options", "Comma-separated options, empty to remove all options.").String()
+
+		securityCmd        = app.Command("security", "Manage security codes.")
+		securityRotateCmd  = securityCmd.Command("rotate", "Set a new security code for a user, which invalidates all tokens of the user.")
+		securityRotateUser = securityRotateCmd.Arg("user", "User name.").Required().String()
+		securityRotateCode = securityRotateCmd.Flag("code", "Security code, a random code is generated when not given.").String()
+
+		secretCmd           = app.Command("secret", "Manage the token secret.")
+		secretGenerateCmd   = secretCmd.Command("generate", "Generate a new random token secret file.")
+		secretGenerateFn    = secretGenerateCmd.Arg("file", "Secret file to create, defaults to --secret.").String()
+		secretGenerateSize  = secretGenerateCmd.Flag("size", "Secret size in bytes (32 or 64).").Default("32").Enum("32", "64")
+		secretGenerateForce = secretGenerateCmd.Flag("force", "Overwrite an existing secret file, which invalidates all tokens.").Bool()
+
+		tokenCmd          = app.Command("token", "Manage tokens.")
+		tokenCreateCmd    = tokenCmd.Command("create", "Create an update token for a host or comma-separated hosts.")
+		tokenCreateHost   = tokenCreateCmd.Arg("host", "Host name, several hosts comma-separated.").Required().String()
+		tokenCreateUser   = tokenCreateCmd.Arg("user", "User name.").Required().String()
+		tokenInspectCmd   = tokenCmd.Command("inspect", "Decode a token and check if it is valid.")
+		tokenInspectToken = tokenInspectCmd.Arg("token", "Token value.").Required().String()
+	)
+
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	// Fill unset file locations from configuration file.
+	if *configfile != "" {
+		files, err := readConfig(*configfile)
+		app.FatalIfError(os.Stderr, err, "error reading config")
+		for _, f := range []struct {
+			target *string
+			value  string
+		}{
+			{usersfile, files.Users},
+			{hostsfile, files.Hosts},
+			{securityfile, files.Security},
+			{secretfile, files.Secret},
+		} {
+			if *f.target == "" {
+				*f.target = f.value
+			}
+		}
+	}
+	ctl := &Ctl{
+		files: &Files{
+			Users:    *usersfile,
+			Hosts:    *hostsfile,
+			Security: *securityfile,
+			Secret:   *secretfile,
+		},
+	}
+
+	var err error
+	switch command {
+	case userListCmd.FullCommand():
+		err = ctl.userList()
+	case userAddCmd.FullCommand():
+		err = ctl.userSetPassword(*userAddName, *userAddPassword, true)
+	case userPasswdCmd.FullCommand():
+		err = ctl.userSetPassword(*userPasswdName, *userPasswdValue, false)
+	case userDisableCmd.FullCommand():
+		err = ctl.userSetDisabled(*userDisableName, true)
+	case userEnableCmd.FullCommand():
+		err = ctl.userSetDisabled(*userEnableName, false)
+	case userEmailCmd.FullCommand():
+		err = ctl.userSetEmail(*userEmailName, *userEmailValue)
+	case hostListCmd.FullCommand():
+		err = ctl.hostList()
+	case hostGrantCmd.FullCommand():
+		err = ctl.hostGrant(*hostGrantHost, *hostGrantUser)
+	case hostRevokeCmd.FullCommand():
+		err = ctl.hostRevoke(*hostRevokeHost, *hostRevokeUser)
+	case hostOptionsCmd.FullCommand():
+		err = ctl.hostOptions(*hostOptionsHost, *hostOptionsSet)
+	case securityRotateCmd.FullCommand():
+		err = ctl.securityRotate(*securityRotateUser, *securityRotateCode)
+	case secretGenerateCmd.FullCommand():
+		fn := *secretGenerateFn
+		if fn == "" {
+			fn = ctl.files.Secret
+		}
+		err = ctl.secretGenerate(fn, *secretGenerateSize, *secretGenerateForce)
+	case tokenCreateCmd.FullCommand():
+		err = ctl.tokenCreate(*tokenCreateHost, *tokenCreateUser)
+	case tokenInspectCmd.FullCommand():
+		err = ctl.tokenInspect(*tokenInspectToken)
+	}
+	if errors.Is(err, errInvalidToken) {
+		// Checking tokens in scripts needs to tell invalid tokens apart
+		// from other errors.
+		os.Exit(2)
+	}
+	app.FatalIfError(os.Stderr, err, "")
+
+}
@@ -0,0 +1,665 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longsleep/mydyns"
+)
+
+// modifylock serializes changes of the database files.
+var modifylock sync.Mutex
+
+// adminError is an error with a HTTP status code, returned to admin clients.
+type adminError struct {
+	status  int
+	message string
+}
+
+func (err *adminError) Error() string {
+	return err.message
+}
+
+func newAdminError(status int, format string, a ...interface{}) error {
+	return &adminError{status, fmt.Sprintf(format, a...)}
+}
+
+// adminDatabases holds freshly loaded databases which get modified by admin
+// requests and written back if changed.
+type adminDatabases struct {
+	users           *mydyns.HtpasswdFile
+	hosts           *mydyns.HostsFile
+	security        *mydyns.SecurityFile
+	usersChanged    bool
+	hostsChanged    bool
+	securityChanged bool
+}
+
+type adminUser struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password,omitempty"`
+	Hash     string   `json:"hash,omitempty"`
+	Email    *string  `json:"email,omitempty"`
+	Hosts    []string `json:"hosts,omitempty"`
+	Security bool     `json:"security"`
+}
+
+type adminHost struct {
+	Name    string   `json:"name"`
+	Unicode string   `json:"unicode,omitempty"`
+	Users   []string `json:"users"`
+	Options *string  `json:"options,omitempty"`
+}
+
+type adminSecurity struct {
+	User string `json:"user"`
+	Code string `json:"code"`
+}
+
+// AdminAPI implements the /admin/ REST API to manage users, hosts and
+// security codes. Changes are written back to the database files and
+// reloaded in process.
+type AdminAPI struct {
+	files *DatabaseFiles
+}
+
+func NewAdminAPI(files *DatabaseFiles) *AdminAPI {
+	return &AdminAPI{
+		files: files,
+	}
+}
+
+func (api *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Basic auth with admin credentials is required.
+	username, password, ok := getBasicAuth(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mydyns admin"`)
+		api.error(w, newAdminError(http.StatusUnauthorized, "basic auth required"))
+		return
+	}
+	// Admins are locked out separately from users with the same name.
+	client := requestAddress(r).String()
+	lockname := "admin:" + username
+	if locked, retry := limits.locked(client, lockname); locked {
+		w.Header().Set("Retry-After", retryAfter(retry))
+		api.error(w, newAdminError(http.StatusTooManyRequests, "too many failed authentications"))
+		return
+	}
+	dblock.RLock()
+	ok = admins != nil && admins.CheckPassword(username, password)
+	exists := admins != nil && admins.Exists(username)
+	dblock.RUnlock()
+	if !ok {
+		log.Println("Admin authentication failed", username)
+		if !exists {
+			lockname = ""
+		}
+		limits.failed(client, lockname)
+		authFailed(requestAddress(r), username, "invalid admin password")
+		api.error(w, newAdminError(http.StatusForbidden, "authentication failed"))
+		return
+	}
+	limits.succeeded(client, lockname)
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/"), "/")
+	parts := strings.Split(path, "/")
+
+	// Remember the previous state of the changed entry for the audit log.
+	var name, old string
+	if len(parts) > 1 {
+		name = parts[1]
+	}
+	if r.Method != http.MethodGet {
+		old = api.state(parts[0], name)
+	}
+
+	var result interface{}
+	var err error
+	switch parts[0] {
+	case "users":
+		result, err = api.users(r, parts[1:])
+	case "hosts":
+		result, err = api.hosts(r, parts[1:])
+	case "security":
+		result, err = api.security(r, parts[1:])
+	case "audit":
+		result, err = api.audit(r, parts[1:])
+	default:
+		err = newAdminError(http.StatusNotFound, "not found")
+	}
+	if err != nil {
+		api.error(w, err)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		log.Println("Admin change by", username, r.Method, r.URL.Path)
+		// Created entries are named in the request body.
+		switch created := result.(type) {
+		case *adminUser:
+			name = created.Name
+		case *adminHost:
+			name = created.Name
+		}
+		event := &auditEvent{
+			Action: auditAdmin,
+			User:   username,
+			Client: requestAddress(r).String(),
+			Old:    old,
+			New:    api.state(parts[0], name),
+			Detail: r.Method + " " + r.URL.Path,
+		}
+		if r.Method == http.MethodDelete {
+			event.Action = auditDelete
+		}
+		if parts[0] == "hosts" && name != "" {
+			event.Host = auditHostname(name)
+		}
+		audit.record(event)
+	}
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// state returns the JSON representation of the user or host name for the
+// audit log, or an empty string if it does not exist. Security codes are
+// part of the user, without revealing the code.
+func (api *AdminAPI) state(kind, name string) string {
+	if name == "" {
+		return ""
+	}
+	dblock.RLock()
+	defer dblock.RUnlock()
+	var value interface{}
+	switch kind {
+	case "users", "security":
+		if !users.Exists(name) {
+			return ""
+		}
+		value = api.user(name)
+	case "hosts":
+		if _, ok := hosts.Users(name); !ok {
+			return ""
+		}
+		value = api.host(name)
+	default:
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func (api *AdminAPI) error(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var ae *adminError
+	if errors.As(err, &ae) {
+		status = ae.status
+	} else {
+		log.Println("Admin request failed", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// modify changes the databases with fn, see modifyDatabases.
+func (api *AdminAPI) modify(fn func(db *adminDatabases) error) error {
+	return modifyDatabases(api.files, fn)
+}
+
+// modifyDatabases loads the databases from their files, applies fn and
+// writes back all changed databases, followed by a reload.
+func modifyDatabases(files *DatabaseFiles, fn func(db *adminDatabases) error) error {
+	modifylock.Lock()
+	defer modifylock.Unlock()
+
+	var err error
+	db := &adminDatabases{}
+	if db.users, err = mydyns.NewHtpasswdFile(files.Users); err != nil {
+		return err
+	}
+	if db.hosts, err = mydyns.NewHostsFile(files.Hosts); err != nil {
+		return err
+	}
+	if db.security, err = mydyns.NewSecurityFile(files.Security); err != nil {
+		return err
+	}
+
+	if err = fn(db); err != nil {
+		return err
+	}
+	// Parse the new content like loadDatabases would before writing
+	// anything, so an invalid change never reaches the files.
+	if _, err = mydyns.ParseHosts(bytes.NewReader(db.hosts.Bytes())); err != nil {
+		return newAdminError(http.StatusConflict, "%s", err)
+	}
+	if _, err = mydyns.ParseSecurity(bytes.NewReader(db.security.Bytes())); err != nil {
+		return newAdminError(http.StatusConflict, "%s", err)
+	}
+	if _, err = mydyns.ParseHtpasswd(bytes.NewReader(db.users.Bytes())); err != nil {
+		return newAdminError(http.StatusConflict, "%s", err)
+	}
+
+	if db.hostsChanged {
+		if err = db.hosts.WriteFile(files.Hosts); err != nil {
+			return err
+		}
+	}
+	if db.securityChanged {
+		if err = db.security.WriteFile(files.Security); err != nil {
+			return err
+		}
+	}
+	if db.usersChanged {
+		if err = db.users.WriteFile(files.Users); err != nil {
+			return err
+		}
+	}
+
+	return loadDatabases(files)
+}
+
+// decode reads the JSON request body into dst.
+func (api *AdminAPI) decode(r *http.Request, dst interface{}) error {
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20)).Decode(dst); err != nil {
+		return newAdminError(http.StatusBadRequest, "invalid request body: %s", err)
+	}
+	return nil
+}
+
+func (api *AdminAPI) users(r *http.Request, parts []string) (interface{}, error) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		dblock.RLock()
+		defer dblock.RUnlock()
+		result := make([]*adminUser, 0)
+		for _, name := range users.Users() {
+			result = append(result, api.user(name))
+		}
+		return result, nil
+
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var data adminUser
+		if err := api.decode(r, &data); err != nil {
+			return nil, err
+		}
+		return api.setUser(data.Name, &data, true)
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		dblock.RLock()
+		defer dblock.RUnlock()
+		if !users.Exists(parts[0]) {
+			return nil, newAdminError(http.StatusNotFound, "user not found")
+		}
+		return api.user(parts[0]), nil
+
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var data adminUser
+		if err := api.decode(r, &data); err != nil {
+			return nil, err
+		}
+		return api.setUser(parts[0], &data, false)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		return nil, api.modify(func(db *adminDatabases) error {
+			name := parts[0]
+			if !db.users.Exists(name) {
+				return newAdminError(http.StatusNotFound, "user not found")
+			}
+			db.users.Delete(name)
+			db.usersChanged = true
+			// Remove user from all hosts, hosts without users are removed.
+			for _, host := range db.hosts.Hosts() {
+				entry, _ := db.hosts.Users(host)
+				if remaining := removeString(entry, name); len(remaining) != len(entry) {
+					if len(remaining) > 0 {
+						db.hosts.Set(host, remaining)
+					} else {
+						db.hosts.Delete(host)
+					}
+					db.hostsChanged = true
+				}
+			}
+			if _, ok := db.security.Code(name); ok {
+				db.security.Delete(name)
+				db.securityChanged = true
+			}
+			return nil
+		})
+	}
+
+	return nil, newAdminError(http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// user returns the admin representation of a user. The caller must hold the
+// database read lock.
+func (api *AdminAPI) user(name string) *adminUser {
+	result := &adminUser{
+		Name: name,
+	}
+	for _, host := range hosts.Hosts() {
+		if hosts.CheckUser(host, name) {
+			result.Hosts = append(result.Hosts, host)
+		}
+	}
+	if code, ok := security.Code(name); ok && code != "" {
+		result.Security = true
+	}
+	if email := users.Email(name); email != "" {
+		result.Email = &email
+	}
+	return result
+}
+
+func (api *AdminAPI) setUser(name string, data *adminUser, create bool) (interface{}, error) {
+	if !mydyns.ValidEntryValue(name) {
+		return nil, newAdminError(http.StatusBadRequest, "invalid user name")
+	}
+	err := api.modify(func(db *adminDatabases) error {
+		if create && db.users.Exists(name) {
+			return newAdminError(http.StatusConflict, "user already exists")
+		}
+		switch {
+		case data.Hash != "":
+			if err := db.users.SetHash(name, data.Hash); err != nil {
+				return newAdminError(http.StatusBadRequest, "%s", err)
+			}
+		case data.Password != "":
+			if err := db.users.SetPassword(name, data.Password); err != nil {
+				return err
+			}
+		case !db.users.Exists(name) || data.Email == nil:
+			// Existing users can be changed without password.
+			return newAdminError(http.StatusBadRequest, "password or hash required")
+		}
+		if data.Email != nil {
+			if err := db.users.SetEmail(name, *data.Email); err != nil {
+				return newAdminError(http.StatusBadRequest, "%s", err)
+			}
+		}
+		db.usersChanged = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dblock.RLock()
+	defer dblock.RUnlock()
+	return api.user(name), nil
+}
+
+func (api *AdminAPI) hosts(r *http.Request, parts []string) (interface{}, error) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		dblock.RLock()
+		defer dblock.RUnlock()
+		result := make([]*adminHost, 0)
+		for _, name := range hosts.Hosts() {
+			result = append(result, api.host(name))
+		}
+		return result, nil
+
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		var data adminHost
+		if err := api.decode(r, &data); err != nil {
+			return nil, err
+		}
+		return api.setHost(data.Name, &data, true)
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		dblock.RLock()
+		defer dblock.RUnlock()
+		if _, ok := hosts.Users(parts[0]); !ok {
+			return nil, newAdminError(http.StatusNotFound, "host not found")
+		}
+		return api.host(parts[0]), nil
+
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var data adminHost
+		if err := api.decode(r, &data); err != nil {
+			return nil, err
+		}
+		return api.setHost(parts[0], &data, false)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		return nil, api.modify(func(db *adminDatabases) error {
+			if _, ok := db.hosts.Users(parts[0]); !ok {
+				return newAdminError(http.StatusNotFound, "host not found")
+			}
+			db.hosts.Delete(parts[0])
+			db.hostsChanged = true
+			return nil
+		})
+
+	case len(parts) == 3 && parts[1] == "users" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		// Assign or unassign a single user.
+		host, user := parts[0], parts[2]
+		err := api.modify(func(db *adminDatabases) error {
+			entry, ok := db.hosts.Users(host)
+			if !ok {
+				return newAdminError(http.StatusNotFound, "host not found")
+			}
+			if r.Method == http.MethodPut {
+				if !db.users.Exists(user) {
+					return newAdminError(http.StatusBadRequest, "unknown user %s", user)
+				}
+				if !db.hosts.CheckUser(host, user) {
+					db.hosts.Set(host, append(entry, user))
+					db.hostsChanged = true
+				}
+				return nil
+			}
+			remaining := removeString(entry, user)
+			if len(remaining) == len(entry) {
+				return newAdminError(http.StatusNotFound, "user not assigned")
+			}
+			if len(remaining) == 0 {
+				return newAdminError(http.StatusConflict, "cannot remove last user of host")
+			}
+			db.hosts.Set(host, remaining)
+			db.hostsChanged = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		dblock.RLock()
+		defer dblock.RUnlock()
+		return api.host(host), nil
+	}
+
+	return nil, newAdminError(http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// host returns the admin representation of a host. The caller must hold the
+// database read lock.
+func (api *AdminAPI) host(name string) *adminHost {
+	if normalized, err := mydyns.NormalizeHostname(name); err == nil {
+		name = normalized
+	}
+	entry, _ := hosts.Users(name)
+	result := &adminHost{
+		Name:    name,
+		Unicode: unicodeName(name),
+		Users:   entry,
+	}
+	if options := hosts.Options(name).String(); options != "" {
+		result.Options = &options
+	}
+	return result
+}
+
+func (api *AdminAPI) setHost(name string, data *adminHost, create bool) (interface{}, error) {
+	name, err := mydyns.NormalizeHostname(name)
+	if err != nil {
+		return nil, newAdminError(http.StatusBadRequest, "invalid hostname")
+	}
+	if len(data.Users) == 0 {
+		return nil, newAdminError(http.StatusBadRequest, "users required")
+	}
+	err = api.modify(func(db *adminDatabases) error {
+		if _, ok := db.hosts.Users(name); ok && create {
+			return newAdminError(http.StatusConflict, "host already exists")
+		}
+		for _, user := range data.Users {
+			if !db.users.Exists(user) {
+				return newAdminError(http.StatusBadRequest, "unknown user %s", user)
+			}
+		}
+		db.hosts.Set(name, data.Users)
+		if data.Options != nil {
+			if err := db.hosts.SetOptions(name, *data.Options); err != nil {
+				return newAdminError(http.StatusBadRequest, "invalid options: %s", err)
+			}
+		}
+		db.hostsChanged = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dblock.RLock()
+	defer dblock.RUnlock()
+	return api.host(name), nil
+}
+
+func (api *AdminAPI) security(r *http.Request, parts []string) (interface{}, error) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		dblock.RLock()
+		defer dblock.RUnlock()
+		result := make([]*adminSecurity, 0)
+		for _, user := range security.Users() {
+			code, _ := security.Code(user)
+			result = append(result, &adminSecurity{user, code})
+		}
+		return result, nil
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		dblock.RLock()
+		defer dblock.RUnlock()
+		code, ok := security.Code(parts[0])
+		if !ok {
+			return nil, newAdminError(http.StatusNotFound, "security code not found")
+		}
+		return &adminSecurity{parts[0], code}, nil
+
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		// Set the given code, or generate a new random one when empty.
+		var data adminSecurity
+		if err := api.decode(r, &data); err != nil {
+			return nil, err
+		}
+		data.User = parts[0]
+		if data.Code == "" {
+			data.Code = mydyns.NewSecurityCode()
+		} else if !mydyns.ValidEntryValue(data.Code) {
+			return nil, newAdminError(http.StatusBadRequest, "invalid security code")
+		}
+		err := api.modify(func(db *adminDatabases) error {
+			if !db.users.Exists(data.User) {
+				return newAdminError(http.StatusNotFound, "user not found")
+			}
+			db.security.Set(data.User, data.Code)
+			db.securityChanged = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &data, nil
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		return nil, api.modify(func(db *adminDatabases) error {
+			if _, ok := db.security.Code(parts[0]); !ok {
+				return newAdminError(http.StatusNotFound, "security code not found")
+			}
+			db.security.Delete(parts[0])
+			db.securityChanged = true
+			return nil
+		})
+	}
+
+	return nil, newAdminError(http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// removeString returns a copy of list without s.
+func removeString(list []string, s string) []string {
+	result := make([]string, 0, len(list))
+	for _, entry := range list {
+		if entry != s {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func (api *AdminAPI) audit(r *http.Request, parts []string) (interface{}, error) {
+	if len(parts) > 0 {
+		return nil, newAdminError(http.StatusNotFound, "not found")
+	}
+	if r.Method != http.MethodGet {
+		return nil, newAdminError(http.StatusMethodNotAllowed, "method not allowed")
+	}
+
+	query := r.URL.Query()
+	filter := &auditFilter{
+		Action: query.Get("action"),
+		User:   query.Get("user"),
+		Host:   auditHostname(query.Get("host")),
+		Limit:  100,
+	}
+	var err error
+	if value := query.Get("since"); value != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, newAdminError(http.StatusBadRequest, "invalid since: %s", err)
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, newAdminError(http.StatusBadRequest, "invalid until: %s", err)
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 0 {
+			return nil, newAdminError(http.StatusBadRequest, "invalid limit")
+		}
+	}
+	return audit.query(filter)
+}
@@ -0,0 +1,265 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAdminAPI sets up the test service with an admin database, which has
+// the admin user with password secret.
+func testAdminAPI(t *testing.T) (*AdminAPI, *DatabaseFiles) {
+	files := setupTestService(t)
+	files.Admins = filepath.Join(filepath.Dir(files.Users), "admins.db")
+	if err := ioutil.WriteFile(files.Admins, []byte("admin:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDatabases(files); err != nil {
+		t.Fatal(err)
+	}
+	return NewAdminAPI(files), files
+}
+
+func adminRequest(api *AdminAPI, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w
+}
+
+// adminStep is a request to the admin API with the expected status and a
+// part of the expected response.
+type adminStep struct {
+	method, path, body string
+	status             int
+	contains           string
+}
+
+func runAdminSteps(t *testing.T, api *AdminAPI, steps []adminStep) {
+	for _, step := range steps {
+		w := adminRequest(api, step.method, step.path, step.body)
+		if w.Code != step.status {
+			t.Errorf("%s %s: got status %d, want %d: %s", step.method, step.path, w.Code, step.status, w.Body)
+		} else if !strings.Contains(w.Body.String(), step.contains) {
+			t.Errorf("%s %s: response does not contain %s: %s", step.method, step.path, step.contains, w.Body)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	api, _ := testAdminAPI(t)
+	tests := []struct {
+		name               string
+		username, password string
+		basic              bool
+		status             int
+	}{
+		{"admin", "admin", "secret", true, http.StatusOK},
+		{"no auth", "", "", false, http.StatusUnauthorized},
+		{"wrong password", "admin", "wrong", true, http.StatusForbidden},
+		{"unknown admin", "root", "secret", true, http.StatusForbidden},
+		{"user", "alice", "secret", true, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+		if test.basic {
+			r.SetBasicAuth(test.username, test.password)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+		if test.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no authentication challenge", test.name)
+		}
+	}
+
+	runAdminSteps(t, api, []adminStep{
+		{http.MethodGet, "/admin/unknown", "", http.StatusNotFound, `"error"`},
+		{http.MethodPatch, "/admin/users", "", http.StatusMethodNotAllowed, `"error"`},
+	})
+}
+
+func TestAdminLockout(t *testing.T) {
+	api, _ := testAdminAPI(t)
+	var err error
+	if limits, err = NewLimits(&LimitsConfig{Failures: 2, Lockout: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(client, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+		r.RemoteAddr = client + ":1234"
+		r.SetBasicAuth("admin", password)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := request("203.0.113.1", "wrong"); w.Code != http.StatusForbidden {
+			t.Fatalf("failure %d: got status %d", i+1, w.Code)
+		}
+	}
+	w := request("203.0.113.1", "secret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("admin should be locked out, got %d", w.Code)
+	}
+	if w = request("203.0.113.2", "secret"); w.Code != http.StatusOK {
+		t.Errorf("other clients should not be locked out, got %d", w.Code)
+	}
+}
+
+func TestAdminUsers(t *testing.T) {
+	api, files := testAdminAPI(t)
+	runAdminSteps(t, api, []adminStep{
+		{http.MethodGet, "/admin/users", "", http.StatusOK, `{"name":"bob","hosts":["office"],"security":true}`},
+		{http.MethodPost, "/admin/users", `{"name": "carol", "password": "pw", "email": "carol@example.com"}`, http.StatusOK, `"email":"carol@example.com"`},
+		{http.MethodPost, "/admin/users", `{"name": "carol", "password": "pw"}`, http.StatusConflict, `"error"`},
+		{http.MethodPost, "/admin/users", `{"name": "dave"}`, http.StatusBadRequest, `"error"`},
+		{http.MethodPost, "/admin/users", `{"name": "eve", "hash": "{SHA}short:evil"}`, http.StatusBadRequest, `"error"`},
+		{http.MethodPost, "/admin/users", `{"name": `, http.StatusBadRequest, `"error"`},
+		{http.MethodPut, "/admin/users/carol", `{"email": "c@example.com"}`, http.StatusOK, `"email":"c@example.com"`},
+		{http.MethodGet, "/admin/users/carol", "", http.StatusOK, `"security":false`},
+		{http.MethodGet, "/admin/users/dave", "", http.StatusNotFound, `"error"`},
+		{http.MethodDelete, "/admin/users/bob", "", http.StatusNoContent, ""},
+		{http.MethodDelete, "/admin/users/bob", "", http.StatusNotFound, `"error"`},
+	})
+
+	// Changes are written and reloaded.
+	dblock.RLock()
+	ok := users.CheckPassword("carol", "pw")
+	_, office := hosts.Users("office")
+	_, code := security.Code("bob")
+	dblock.RUnlock()
+	if !ok {
+		t.Error("carol should be able to log in")
+	}
+	if office || code {
+		t.Error("bob's host and security code should be removed with bob")
+	}
+	data, err := ioutil.ReadFile(files.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "carol:") || strings.Contains(string(data), "bob:") {
+		t.Errorf("unexpected users database %q", data)
+	}
+}
+
+func TestAdminHosts(t *testing.T) {
+	api, _ := testAdminAPI(t)
+	runAdminSteps(t, api, []adminStep{
+		{http.MethodPost, "/admin/hosts", `{"name": "Cabin", "users": ["alice"]}`, http.StatusOK, `{"name":"cabin","users":["alice"]}`},
+		{http.MethodPost, "/admin/hosts", `{"name": "cabin", "users": ["bob"]}`, http.StatusConflict, `"error"`},
+		{http.MethodPost, "/admin/hosts", `{"name": "lodge", "users": ["carol"]}`, http.StatusBadRequest, `unknown user carol`},
+		{http.MethodPost, "/admin/hosts", `{"name": "lodge"}`, http.StatusBadRequest, `users required`},
+		{http.MethodPost, "/admin/hosts", `{"name": "my_host", "users": ["alice"]}`, http.StatusBadRequest, `invalid hostname`},
+		{http.MethodPost, "/admin/hosts", `{"name": "münchen", "users": ["alice"]}`, http.StatusOK, `"unicode":"münchen"`},
+		{http.MethodPut, "/admin/hosts/cabin", `{"users": ["alice"], "options": "wildcard"}`, http.StatusOK, `"options":"wildcard"`},
+		{http.MethodPut, "/admin/hosts/cabin", `{"users": ["alice"], "options": "unknown"}`, http.StatusBadRequest, `invalid options`},
+		{http.MethodGet, "/admin/hosts/cabin", "", http.StatusOK, `"options":"wildcard"`},
+		{http.MethodGet, "/admin/hosts/lodge", "", http.StatusNotFound, `"error"`},
+		{http.MethodGet, "/admin/hosts", "", http.StatusOK, `{"name":"home","users":["alice"]}`},
+
+		// Assignments of single users.
+		{http.MethodPut, "/admin/hosts/cabin/users/bob", "", http.StatusOK, `"users":["alice","bob"]`},
+		{http.MethodPut, "/admin/hosts/cabin/users/bob", "", http.StatusOK, `"users":["alice","bob"]`},
+		{http.MethodPut, "/admin/hosts/cabin/users/carol", "", http.StatusBadRequest, `unknown user carol`},
+		{http.MethodPut, "/admin/hosts/lodge/users/bob", "", http.StatusNotFound, `host not found`},
+		{http.MethodDelete, "/admin/hosts/cabin/users/alice", "", http.StatusOK, `"users":["bob"]`},
+		{http.MethodDelete, "/admin/hosts/cabin/users/alice", "", http.StatusNotFound, `user not assigned`},
+		{http.MethodDelete, "/admin/hosts/cabin/users/bob", "", http.StatusConflict, `last user`},
+
+		{http.MethodDelete, "/admin/hosts/cabin", "", http.StatusNoContent, ""},
+		{http.MethodDelete, "/admin/hosts/cabin", "", http.StatusNotFound, `"error"`},
+	})
+}
+
+func TestAdminSecurity(t *testing.T) {
+	api, files := testAdminAPI(t)
+	if err := ioutil.WriteFile(files.Users, []byte(testUsers+"carol:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDatabases(files); err != nil {
+		t.Fatal(err)
+	}
+	runAdminSteps(t, api, []adminStep{
+		{http.MethodGet, "/admin/security", "", http.StatusOK, `{"user":"alice","code":"alicecode"}`},
+		{http.MethodGet, "/admin/security/bob", "", http.StatusOK, `{"user":"bob","code":"bobcode"}`},
+		{http.MethodGet, "/admin/security/carol", "", http.StatusNotFound, `"error"`},
+		{http.MethodPut, "/admin/security/carol", `{"code": "carolcode"}`, http.StatusOK, `{"user":"carol","code":"carolcode"}`},
+		{http.MethodPut, "/admin/security/carol", `{"code": "bad:code"}`, http.StatusBadRequest, `invalid security code`},
+		{http.MethodPut, "/admin/security/dave", `{"code": "davecode"}`, http.StatusNotFound, `user not found`},
+		{http.MethodDelete, "/admin/security/bob", "", http.StatusNoContent, ""},
+		{http.MethodDelete, "/admin/security/bob", "", http.StatusNotFound, `"error"`},
+	})
+
+	// Empty codes are generated.
+	w := adminRequest(api, http.MethodPut, "/admin/security/bob", `{}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("generating code failed: %d %s", w.Code, w.Body)
+	}
+	dblock.RLock()
+	code, ok := security.Code("bob")
+	dblock.RUnlock()
+	if !ok || code == "" || code == "bobcode" || !strings.Contains(w.Body.String(), code) {
+		t.Errorf("unexpected generated code %q: %s", code, w.Body)
+	}
+}
+
+func TestModifyDatabasesValidatesBeforeWriting(t *testing.T) {
+	const usersContent = "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"
+	const hostsContent = "home:alice\n"
+	files := testDatabaseFiles(t, usersContent, hostsContent, "")
+
+	err := modifyDatabases(files, func(db *adminDatabases) error {
+		if err := db.users.SetPassword("bob", "secret"); err != nil {
+			return err
+		}
+		db.usersChanged = true
+		db.hosts.Set("office", []string{"bob:invalid"})
+		db.hostsChanged = true
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected invalid hosts entry to fail")
+	}
+
+	for fn, expected := range map[string]string{
+		files.Users: usersContent,
+		files.Hosts: hostsContent,
+	} {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("%s was modified: %q", filepath.Base(fn), data)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the path of the current version of the JSON API.
+const apiPrefix = "/api/v1/"
+
+type apiTokenRequest struct {
+	Hosts []string `json:"hosts"`
+}
+
+type apiTokenResponse struct {
+	Token string    `json:"token"`
+	Hosts []apiHost `json:"hosts"`
+}
+
+// apiHost is the normalized name of a host, with its Unicode form for
+// internationalized names.
+type apiHost struct {
+	Name    string `json:"name"`
+	Unicode string `json:"unicode,omitempty"`
+}
+
+type apiUpdateRequest struct {
+	Token string `json:"token"`
+	IP    string `json:"ip,omitempty"`
+}
+
+type apiRegisterRequest struct {
+	Host string `json:"host"`
+}
+
+type apiStatus struct {
+	Status  string    `json:"status"`
+	Version string    `json:"version"`
+	Loaded  time.Time `json:"loaded"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type apiErrorResponse struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// API implements the versioned JSON API with token, update, check and status
+// endpoints. It provides the same functions as the legacy endpoints, but
+// errors come with stable error codes.
+type API struct {
+	registration *Registration
+}
+
+func NewAPI(registration *Registration) *API {
+	return &API{
+		registration: registration,
+	}
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+
+	var result interface{}
+	var err error
+	switch path {
+	case "token":
+		result, err = api.token(r)
+	case "update":
+		result, err = api.update(r, false)
+	case "check":
+		result, err = api.update(r, true)
+	case "status":
+		result, err = api.status(r)
+	case "hosts":
+		result, err = api.hosts(r)
+	case "register":
+		result, err = api.register(r)
+	default:
+		err = newServiceError(http.StatusNotFound, "not_found", "not found")
+	}
+	if err != nil {
+		api.error(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (api *API) error(w http.ResponseWriter, err error) {
+	se := &serviceError{http.StatusInternalServerError, "internal_error", err.Error(), 0}
+	if !errors.As(err, &se) {
+		log.Println("API request failed", err)
+	}
+	if retry := retryAfter(se.retry); retry != "" {
+		w.Header().Set("Retry-After", retry)
+	}
+	if se.code == "auth_required" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mydyns"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(se.status)
+	json.NewEncoder(w).Encode(&apiErrorResponse{apiErrorDetail{se.code, se.message}})
+}
+
+// decode checks the request method and reads the JSON request body into dst.
+func (api *API) decode(r *http.Request, method string, dst interface{}) error {
+	if r.Method != method {
+		return newServiceError(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20)).Decode(dst); err != nil {
+		return newServiceError(http.StatusBadRequest, "invalid_request", "invalid request body: %s", err)
+	}
+	return nil
+}
+
+func (api *API) token(r *http.Request) (interface{}, error) {
+	// Basic auth is required.
+	username, password, ok := getBasicAuth(r)
+	if !ok {
+		return nil, newServiceError(http.StatusUnauthorized, "auth_required", "basic auth required")
+	}
+	var data apiTokenRequest
+	if err := api.decode(r, http.MethodPost, &data); err != nil {
+		return nil, err
+	}
+	if len(data.Hosts) == 0 {
+		return nil, newServiceError(http.StatusBadRequest, "hostname_required", "hosts required")
+	}
+	token, hostnames, err := createToken(r, username, password, strings.Join(data.Hosts, ","))
+	if err != nil {
+		return nil, err
+	}
+	response := &apiTokenResponse{Token: token}
+	for _, hostname := range hostnames {
+		response.Hosts = append(response.Hosts, apiHost{hostname, unicodeName(hostname)})
+	}
+	return response, nil
+}
+
+func (api *API) update(r *http.Request, check bool) (interface{}, error) {
+	var data apiUpdateRequest
+	if err := api.decode(r, http.MethodPost, &data); err != nil {
+		return nil, err
+	}
+	return updateHosts(r, data.Token, data.IP, check)
+}
+
+func (api *API) hosts(r *http.Request) (interface{}, error) {
+	var data apiUpdateRequest
+	if r.Method == http.MethodGet {
+		data.Token = r.URL.Query().Get("token")
+	} else if err := api.decode(r, http.MethodPost, &data); err != nil {
+		return nil, err
+	}
+	username, password, basic := getBasicAuth(r)
+	return hostsStatus(r, data.Token, username, password, basic)
+}
+
+func (api *API) register(r *http.Request) (interface{}, error) {
+	if api.registration == nil {
+		return nil, newServiceError(http.StatusNotFound, "not_found", "registration is disabled")
+	}
+	// Basic auth is required.
+	username, password, ok := getBasicAuth(r)
+	if !ok {
+		return nil, newServiceError(http.StatusUnauthorized, "auth_required", "basic auth required")
+	}
+	var data apiRegisterRequest
+	if err := api.decode(r, http.MethodPost, &data); err != nil {
+		return nil, err
+	}
+	hostname, err := api.registration.register(r, username, password, data.Host)
+	if err != nil {
+		return nil, err
+	}
+	return &apiHost{hostname, unicodeName(hostname)}, nil
+}
+
+func (api *API) status(r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, newServiceError(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+	dblock.RLock()
+	loaded := dbstatus.loaded
+	err := dbstatus.err
+	dblock.RUnlock()
+
+	result := &apiStatus{
+		Status:  "ok",
+		Version: version,
+		Loaded:  loaded,
+	}
+	if err != nil {
+		result.Status = "degraded"
+		result.Error = err.Error()
+	}
+	return result, nil
+}
@@ -0,0 +1,139 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// apiRequest sends a request to api and returns the recorded response.
+func apiRequest(api *API, method, path, body string, auth bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = "203.0.113.1:1234"
+	if auth {
+		r.SetBasicAuth("alice", "secret")
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIErrors(t *testing.T) {
+	setupTestService(t)
+	api := NewAPI(nil)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		auth   bool
+		status int
+		code   string
+	}{
+		{"unknown endpoint", http.MethodGet, "/api/v1/unknown", "", false, http.StatusNotFound, "not_found"},
+		{"token without auth", http.MethodPost, "/api/v1/token", `{"hosts": ["home"]}`, false, http.StatusUnauthorized, "auth_required"},
+		{"token with GET", http.MethodGet, "/api/v1/token", "", true, http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"token without hosts", http.MethodPost, "/api/v1/token", `{"hosts": []}`, true, http.StatusBadRequest, "hostname_required"},
+		{"token of other host", http.MethodPost, "/api/v1/token", `{"hosts": ["office"]}`, true, http.StatusForbidden, "access_denied"},
+		{"invalid body", http.MethodPost, "/api/v1/update", `{"token":`, false, http.StatusBadRequest, "invalid_request"},
+		{"update without token", http.MethodPost, "/api/v1/update", `{}`, false, http.StatusBadRequest, "token_required"},
+		{"update with invalid token", http.MethodPost, "/api/v1/update", `{"token": "invalid"}`, false, http.StatusForbidden, "invalid_token"},
+		{"status with POST", http.MethodPost, "/api/v1/status", "", false, http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"registration disabled", http.MethodPost, "/api/v1/register", `{"host": "new"}`, true, http.StatusNotFound, "not_found"},
+	}
+	for _, test := range tests {
+		w := apiRequest(api, test.method, test.path, test.body, test.auth)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: unexpected Content-Type %q", test.name, contentType)
+		}
+		var response apiErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Errorf("%s: invalid error response %q: %v", test.name, w.Body.String(), err)
+		} else if response.Error.Code != test.code || response.Error.Message == "" {
+			t.Errorf("%s: got error %+v, want code %s", test.name, response.Error, test.code)
+		}
+		if test.code == "auth_required" && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: WWW-Authenticate header missing", test.name)
+		}
+	}
+}
+
+func TestAPITokenAndCheck(t *testing.T) {
+	setupTestService(t)
+	api := NewAPI(nil)
+
+	w := apiRequest(api, http.MethodPost, "/api/v1/token", `{"hosts": ["HOME"]}`, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("token failed: %d %s", w.Code, w.Body.String())
+	}
+	var token apiTokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatal(err)
+	}
+	if token.Token == "" || len(token.Hosts) != 1 || token.Hosts[0] != (apiHost{Name: "home"}) {
+		t.Errorf("unexpected token response %+v", token)
+	}
+
+	body, _ := json.Marshal(&apiUpdateRequest{Token: token.Token})
+	w = apiRequest(api, http.MethodPost, "/api/v1/check", string(body), false)
+	if w.Code != http.StatusOK {
+		t.Fatalf("check failed: %d %s", w.Code, w.Body.String())
+	}
+	if result := strings.TrimSpace(w.Body.String()); result != `{"ip":"203.0.113.1"}` {
+		t.Errorf("unexpected check response %s", result)
+	}
+
+	w = apiRequest(api, http.MethodGet, "/api/v1/status/", "", false)
+	var status apiStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || status.Status != "ok" || status.Version != version {
+		t.Errorf("unexpected status %d %+v", w.Code, status)
+	}
+}
+
+func TestAPIRegister(t *testing.T) {
+	files := setupTestService(t)
+	reg, err := NewRegistration(&RegistrationConfig{}, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(reg)
+
+	w := apiRequest(api, http.MethodPost, "/api/v1/register", `{"host": "München"}`, true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("register failed: %d %s", w.Code, w.Body.String())
+	}
+	var host apiHost
+	if err := json.Unmarshal(w.Body.Bytes(), &host); err != nil {
+		t.Fatal(err)
+	}
+	if host != (apiHost{"xn--mnchen-3ya", "münchen"}) {
+		t.Errorf("unexpected register response %+v", host)
+	}
+}
@@ -0,0 +1,296 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/longsleep/mydyns"
+)
+
+// Audit event actions.
+const (
+	auditToken        = "token"
+	auditUpdate       = "update"
+	auditUpdateFailed = "update_failed"
+	auditAuthFailed   = "auth_failed"
+	auditAdmin        = "admin"
+	auditDelete       = "delete"
+	auditRegister     = "register"
+)
+
+// auditEvent is a single entry of the audit log.
+type auditEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	User   string    `json:"user,omitempty"`
+	Host   string    `json:"host,omitempty"`
+	Client string    `json:"client,omitempty"`
+	Old    string    `json:"old,omitempty"`
+	New    string    `json:"new,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// auditFilter selects audit events. Empty fields match everything.
+type auditFilter struct {
+	Action string
+	User   string
+	Host   string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (filter *auditFilter) match(event *auditEvent) bool {
+	return (filter.Action == "" || event.Action == filter.Action) &&
+		(filter.User == "" || event.User == filter.User) &&
+		(filter.Host == "" || event.Host == filter.Host) &&
+		(filter.Since.IsZero() || !event.Time.Before(filter.Since)) &&
+		(filter.Until.IsZero() || event.Time.Before(filter.Until))
+}
+
+// auditHostname returns host as recorded in the audit log, which are the
+// punycode names of the hosts database.
+func auditHostname(host string) string {
+	if name, err := mydyns.NormalizeHostname(host); err == nil {
+		return name
+	}
+	return host
+}
+
+// AuditLog appends events to a file with one JSON object per line. Events
+// older than the retention are removed regularly. Without file, nothing is
+// recorded.
+//
+// Events are written by the run worker, so recording does not wait for the
+// file while callers hold locks.
+type AuditLog struct {
+	file      string
+	retention time.Duration
+	out       *os.File
+	queue     chan []byte
+	flushed   chan chan bool
+	exit      chan bool
+	done      chan bool
+}
+
+func NewAuditLog(file string, retention time.Duration) *AuditLog {
+	return &AuditLog{
+		file:      file,
+		retention: retention,
+		queue:     make(chan []byte, 1000),
+		flushed:   make(chan chan bool),
+		exit:      make(chan bool),
+		done:      make(chan bool),
+	}
+}
+
+// record queues event to be appended to the audit log. It only blocks while
+// the queue is full, events are never dropped.
+func (audit *AuditLog) record(event *auditEvent) {
+	if audit.file == "" {
+		return
+	}
+	event.Time = time.Now()
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Failed to encode audit event", err)
+		return
+	}
+	audit.queue <- append(data, '\n')
+}
+
+// flush waits until the worker has written all queued events.
+func (audit *AuditLog) flush() {
+	if audit.file == "" {
+		return
+	}
+	done := make(chan bool)
+	audit.flushed <- done
+	<-done
+}
+
+// query returns the latest events which match filter, oldest first.
+func (audit *AuditLog) query(filter *auditFilter) ([]*auditEvent, error) {
+	result := make([]*auditEvent, 0)
+	if audit.file == "" {
+		return result, nil
+	}
+
+	// Include everything which was recorded before. Lines which are still
+	// being written are skipped.
+	audit.flush()
+	err := audit.read(func(event *auditEvent, line []byte) {
+		if filter.match(event) {
+			result = append(result, event)
+		}
+	})
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[len(result)-filter.Limit:]
+	}
+	return result, err
+}
+
+// expire removes all events older than the retention. It is called by the
+// worker, which reopens the file afterwards.
+func (audit *AuditLog) expire() error {
+	if audit.file == "" || audit.retention <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().Add(-audit.retention)
+	var buf bytes.Buffer
+	removed := 0
+	err := audit.read(func(event *auditEvent, line []byte) {
+		if event.Time.Before(cutoff) {
+			removed++
+			return
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	})
+	if err != nil || removed == 0 {
+		return err
+	}
+	if err = mydyns.WriteFileAtomic(audit.file, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	log.Printf("Removed %d expired audit events\n", removed)
+	return nil
+}
+
+// read calls fn for every event in the audit log file. It opens its own file
+// handle, expire replaces the file by renaming, so the handle always sees a
+// complete previous or new version.
+func (audit *AuditLog) read(fn func(event *auditEvent, line []byte)) error {
+	f, err := os.Open(audit.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// Skip broken lines, for example after a crash while writing.
+			continue
+		}
+		fn(&event, scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+// run is the worker, which writes the queued events and removes expired
+// events regularly.
+func (audit *AuditLog) run() {
+	c := time.Tick(time.Hour)
+	audit.expireAndReopen()
+	for {
+		select {
+		case data := <-audit.queue:
+			audit.write(data)
+		case done := <-audit.flushed:
+			audit.collect()
+			close(done)
+		case <-c:
+			audit.collect()
+			audit.expireAndReopen()
+		case <-audit.exit:
+			audit.collect()
+			if audit.out != nil {
+				audit.out.Close()
+			}
+			close(audit.done)
+			return
+		}
+	}
+}
+
+// collect writes all queued events without blocking.
+func (audit *AuditLog) collect() {
+	for {
+		select {
+		case data := <-audit.queue:
+			audit.write(data)
+		default:
+			return
+		}
+	}
+}
+
+// write appends data to the audit log file, which is kept open.
+func (audit *AuditLog) write(data []byte) {
+	if audit.out == nil {
+		f, err := os.OpenFile(audit.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Println("Failed to write audit log", err)
+			return
+		}
+		audit.out = f
+	}
+	if _, err := audit.out.Write(data); err != nil {
+		log.Println("Failed to write audit log", err)
+		// Open the file again with the next event.
+		audit.out.Close()
+		audit.out = nil
+	}
+}
+
+// expireAndReopen removes expired events. The file is replaced by expire, so
+// it is opened again with the next event.
+func (audit *AuditLog) expireAndReopen() {
+	if audit.out != nil {
+		audit.out.Close()
+		audit.out = nil
+	}
+	if err := audit.expire(); err != nil {
+		log.Println("Failed to expire audit log", err)
+	}
+}
+
+// stop makes the worker write all queued events and waits until it has
+// exited or ctx is done.
+func (audit *AuditLog) stop(ctx context.Context) error {
+	if audit.file == "" {
+		return nil
+	}
+	select {
+	case audit.exit <- true:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-audit.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
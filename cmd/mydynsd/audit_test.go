@@ -0,0 +1,196 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditFilterMatch(t *testing.T) {
+	now := time.Now()
+	event := &auditEvent{Time: now, Action: auditUpdate, User: "alice", Host: "home"}
+	tests := []struct {
+		name   string
+		filter auditFilter
+		match  bool
+	}{
+		{"empty", auditFilter{}, true},
+		{"action", auditFilter{Action: auditUpdate}, true},
+		{"other action", auditFilter{Action: auditToken}, false},
+		{"user", auditFilter{User: "alice"}, true},
+		{"other user", auditFilter{User: "bob"}, false},
+		{"host", auditFilter{Host: "home"}, true},
+		{"other host", auditFilter{Host: "office"}, false},
+		{"since", auditFilter{Since: now}, true},
+		{"since later", auditFilter{Since: now.Add(time.Second)}, false},
+		{"until", auditFilter{Until: now.Add(time.Second)}, true},
+		{"until now", auditFilter{Until: now}, false},
+		{"all", auditFilter{Action: auditUpdate, User: "alice", Host: "home", Since: now.Add(-time.Second), Until: now.Add(time.Second)}, true},
+	}
+	for _, test := range tests {
+		if match := test.filter.match(event); match != test.match {
+			t.Errorf("%s: match = %v, want %v", test.name, match, test.match)
+		}
+	}
+}
+
+// testAuditLog returns an audit log in a temporary directory, with its
+// worker running until the test is done.
+func testAuditLog(t *testing.T, retention time.Duration) *AuditLog {
+	auditLog := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"), retention)
+	go auditLog.run()
+	t.Cleanup(func() {
+		if err := auditLog.stop(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return auditLog
+}
+
+func TestAuditLogQuery(t *testing.T) {
+	auditLog := testAuditLog(t, time.Hour)
+	for _, host := range []string{"home", "office", "home", "home"} {
+		auditLog.record(&auditEvent{Action: auditUpdate, User: "alice", Host: host})
+	}
+	// A partially written line is skipped.
+	auditLog.flush()
+	f, err := ioutil.ReadFile(auditLog.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(auditLog.file, append(f, []byte(`{"action":"upd`)...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := auditLog.query(&auditFilter{Host: "home", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	for _, event := range events {
+		if event.Host != "home" {
+			t.Errorf("unexpected host %s", event.Host)
+		}
+	}
+}
+
+func TestAuditLogExpire(t *testing.T) {
+	auditLog := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"), time.Hour)
+	old := `{"time":"` + time.Now().Add(-2*time.Hour).Format(time.RFC3339) + `","action":"update","host":"home"}` + "\n"
+	if err := ioutil.WriteFile(auditLog.file, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The worker removes expired events when it starts and writes new
+	// events into the replaced file.
+	go auditLog.run()
+	defer auditLog.stop(context.Background())
+	auditLog.record(&auditEvent{Action: auditUpdate, Host: "office"})
+
+	events, err := auditLog.query(&auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Host != "office" {
+		t.Errorf("unexpected events after expiry: %v", events)
+	}
+}
+
+func TestAuditTokenPerHost(t *testing.T) {
+	setupTestService(t)
+	audit = testAuditLog(t, 0)
+	defer func() { audit = NewAuditLog("", 0) }()
+	dblock.Lock()
+	hosts.Set("cabin", []string{"alice"})
+	dblock.Unlock()
+
+	if _, _, err := createToken(testRequest(), "alice", "secret", "home,cabin"); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"home", "cabin"} {
+		events, err := audit.query(&auditFilter{Action: auditToken, Host: host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 {
+			t.Errorf("expected one token event for %s, got %d", host, len(events))
+		}
+	}
+}
+
+func TestAuditAdminChanges(t *testing.T) {
+	api, _ := testAdminAPI(t)
+	audit = testAuditLog(t, 0)
+	defer func() { audit = NewAuditLog("", 0) }()
+
+	requests := []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/admin/hosts", `{"name": "cabin", "users": ["alice"]}`},
+		{http.MethodPut, "/admin/hosts/cabin/users/bob", ""},
+		{http.MethodDelete, "/admin/hosts/cabin", ""},
+	}
+	for _, request := range requests {
+		if w := adminRequest(api, request.method, request.path, request.body); w.Code >= 300 {
+			t.Fatalf("%s %s failed: %d %s", request.method, request.path, w.Code, w.Body)
+		}
+	}
+
+	events, err := audit.query(&auditFilter{Host: "cabin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	users := func(value string) []string {
+		if value == "" {
+			return nil
+		}
+		var host adminHost
+		if err := json.Unmarshal([]byte(value), &host); err != nil {
+			t.Fatal(err)
+		}
+		return host.Users
+	}
+	expected := []struct {
+		old, new []string
+	}{
+		{nil, []string{"alice"}},
+		{[]string{"alice"}, []string{"alice", "bob"}},
+		{[]string{"alice", "bob"}, nil},
+	}
+	for idx, event := range events {
+		if old := users(event.Old); strings.Join(old, ",") != strings.Join(expected[idx].old, ",") {
+			t.Errorf("event %d: unexpected old value %s", idx, event.Old)
+		}
+		if new := users(event.New); strings.Join(new, ",") != strings.Join(expected[idx].new, ",") {
+			t.Errorf("event %d: unexpected new value %s", idx, event.New)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/longsleep/mydyns"
+)
+
+// Backend publishes the records of updates. The NsUpdate worker collects
+// updates into batches and hands them to its backend.
+type Backend interface {
+	// process publishes all updates of work in one batch. The work is
+	// applied only when no error is returned, otherwise it is retried.
+	process(ctx context.Context, work map[string]*nsUpdateData) error
+}
+
+// Backend names.
+const (
+	backendNsUpdate  = "nsupdate"
+	backendDNS       = "dns"
+	backendZoneFile  = "zonefile"
+	backendPowerDNS  = "powerdns"
+	backendHostsFile = "hostsfile"
+)
+
+// requireState checks that records are kept in a state file, for backends
+// which publish all records from the record store. Without state all hosts
+// would be lost with the first update after a restart.
+func requireState(records *RecordStore) error {
+	if records.file == "" {
+		return errors.New("state file required, set --state")
+	}
+	return nil
+}
+
+// currentAddresses returns the addresses of all hosts as they are after work
+// was applied, for backends which publish all records at once. Hosts which
+// were removed from the hosts database are left out.
+func currentAddresses(records *RecordStore, work map[string]*nsUpdateData) map[string][]net.IP {
+	addresses := records.addresses()
+	for _, data := range work {
+		var current []net.IP
+		for _, ip := range addresses[data.hostname] {
+			if recordType(ip) != recordType(*data.ip) {
+				current = append(current, ip)
+			}
+		}
+		addresses[data.hostname] = append(current, *data.ip)
+	}
+	dblock.RLock()
+	for hostname := range addresses {
+		if _, ok := hosts.Users(hostname); !ok {
+			delete(addresses, hostname)
+		}
+	}
+	dblock.RUnlock()
+	return addresses
+}
+
+// validHostnames returns the names of all hosts in addresses sorted. Never
+// publish anything but valid names, invalid ones are skipped.
+func validHostnames(addresses map[string][]net.IP) []string {
+	hostnames := make([]string, 0, len(addresses))
+	for hostname := range addresses {
+		if !mydyns.ValidHostname(hostname) {
+			log.Println("Skipping invalid hostname", hostname)
+			continue
+		}
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// generatedFile is a file which a backend writes from the records of all
+// hosts, with the command which makes the DNS server read it again.
+type generatedFile struct {
+	file    string
+	reload  []string
+	written []byte
+}
+
+// unchanged checks if content was already written and reloaded.
+func (gf *generatedFile) unchanged(content []byte) bool {
+	return bytes.Equal(content, gf.written)
+}
+
+// publish writes data to the file, calls written and runs the reload
+// command. content is what unchanged compares with later, it is only
+// remembered after the reload, so failures are retried.
+func (gf *generatedFile) publish(ctx context.Context, content, data []byte, written func() error) error {
+	if err := mydyns.WriteFileAtomic(gf.file, data, 0644); err != nil {
+		return err
+	}
+	if written != nil {
+		if err := written(); err != nil {
+			return err
+		}
+	}
+	if len(gf.reload) > 0 {
+		cmd := exec.CommandContext(ctx, gf.reload[0], gf.reload[1:]...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("reload failed: %w: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	gf.written = content
+	return nil
+}
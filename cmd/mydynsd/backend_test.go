@@ -0,0 +1,53 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+package main
+
+import (
+	"testing"
+)
+
+func TestBackendsRequireState(t *testing.T) {
+	records, err := NewRecordStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	soa := SOAConfig{Nameservers: []string{"ns1.example.com"}}
+	tests := []struct {
+		name string
+		new  func() error
+	}{
+		{"dns", func() error {
+			_, err := NewDNSServer(&DNSServerConfig{SOAConfig: soa}, "dyn.example.com", 60, records)
+			return err
+		}},
+		{"zonefile", func() error {
+			_, err := NewZoneFile(&ZoneFileConfig{SOAConfig: soa, File: "dyn.example.com.zone"}, "dyn.example.com", 60, records)
+			return err
+		}},
+		{"hostsfile", func() error {
+			_, err := NewHostsFileBackend(&HostsFileConfig{File: "dnsmasq.hosts"}, "dyn.example.com", records)
+			return err
+		}},
+	}
+	for _, test := range tests {
+		if err := test.new(); err == nil {
+			t.Errorf("%s: expected error without state file", test.name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix is the prefix of environment variables which override options.
+const envPrefix = "MYDYNS_"
+
+// Config holds the options read from a YAML configuration file. Every
+// command line flag can be set in the configuration file with the flag name
+// as key. Environment variables and command line flags take precedence over
+// the configuration file.
+type Config struct {
+	fn       string
+	data     []byte
+	values   map[string]interface{}
+	options  map[string]string
+	flags    map[string]bool
+	sections map[string]bool
+}
+
+func NewConfig(fn string) (*Config, error) {
+	c := &Config{
+		fn:       fn,
+		values:   make(map[string]interface{}),
+		options:  make(map[string]string),
+		flags:    make(map[string]bool),
+		sections: make(map[string]bool),
+	}
+	if fn == "" {
+		return c, nil
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, &c.values); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	c.data = data
+
+	for key, value := range c.values {
+		switch value.(type) {
+		case nil:
+		case map[interface{}]interface{}, []interface{}:
+			// Structured sections are decoded on demand.
+		default:
+			c.options[key] = fmt.Sprint(value)
+		}
+	}
+
+	return c, nil
+}
+
+// configFileFromArgs returns the configuration file given with the --config
+// flag or the environment, without parsing the full command line.
+func configFileFromArgs(args []string) string {
+	for idx, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--config" && idx+1 < len(args) {
+			return args[idx+1]
+		}
+		if strings.HasPrefix(arg, "--config=") {
+			return strings.TrimPrefix(arg, "--config=")
+		}
+	}
+	return os.Getenv(envName("config"))
+}
+
+// envName returns the environment variable name for an option.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Flag defines a command line flag which can also be set in the configuration
+// file and with an environment variable. The default value is used, when the
+// option is not set anywhere.
+func (c *Config) Flag(name, help, defaultValue string) *kingpin.FlagClause {
+	c.flags[name] = true
+	f := kingpin.Flag(name, help).OverrideDefaultFromEnvar(envName(name))
+	if value, ok := c.options[name]; ok {
+		defaultValue = value
+	}
+	if defaultValue != "" {
+		f.Default(defaultValue)
+	}
+	return f
+}
+
+// RequiredFlag defines a flag like Flag, which must be set either on the
+// command line, in the environment or in the configuration file.
+func (c *Config) RequiredFlag(name, help string) *kingpin.FlagClause {
+	f := c.Flag(name, help, "")
+	if _, ok := c.options[name]; !ok {
+		f.Required()
+	}
+	return f
+}
+
+// Section decodes the structured configuration section with the given name
+// into dst. Missing sections leave dst unchanged.
+func (c *Config) Section(name string, dst interface{}) error {
+	c.sections[name] = true
+	value, ok := c.values[name]
+	if !ok || value == nil {
+		return nil
+	}
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err = yaml.UnmarshalStrict(data, dst); err != nil {
+		return fmt.Errorf("%s: %s: %w", c.fn, name, err)
+	}
+	return nil
+}
+
+// Check returns an error if the configuration file contains unknown keys or
+// structured values for options which expect a single value.
+func (c *Config) Check() error {
+	var unknown []string
+	for key, value := range c.values {
+		switch {
+		case c.flags[key]:
+			if _, ok := c.options[key]; !ok && value != nil {
+				return fmt.Errorf("%s: option %s requires a single value", c.fn, key)
+			}
+		case c.sections[key]:
+		default:
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown options %s", c.fn, strings.Join(unknown, ", "))
+	}
+	return nil
+}
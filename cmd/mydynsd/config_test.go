@@ -0,0 +1,167 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigFileFromArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"none", []string{"--listen", ":8040"}, ""},
+		{"separate", []string{"--listen", ":8040", "--config", "mydynsd.yaml"}, "mydynsd.yaml"},
+		{"equals", []string{"--config=mydynsd.yaml", "--listen", ":8040"}, "mydynsd.yaml"},
+		{"missing value", []string{"--config"}, ""},
+		{"after separator", []string{"--", "--config", "mydynsd.yaml"}, ""},
+	}
+	for _, test := range tests {
+		if result := configFileFromArgs(test.args); result != test.expected {
+			t.Errorf("%s: got %q, want %q", test.name, result, test.expected)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"config", "MYDYNS_CONFIG"},
+		{"allow-private", "MYDYNS_ALLOW_PRIVATE"},
+		{"audit-retention", "MYDYNS_AUDIT_RETENTION"},
+	}
+	for _, test := range tests {
+		if result := envName(test.name); result != test.expected {
+			t.Errorf("envName(%q) = %q, want %q", test.name, result, test.expected)
+		}
+	}
+}
+
+// testConfig returns the configuration read from a file with content.
+func testConfig(t *testing.T, content string) (*Config, error) {
+	fn := filepath.Join(t.TempDir(), "mydynsd.yaml")
+	if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return NewConfig(fn)
+}
+
+func TestNewConfig(t *testing.T) {
+	c, err := testConfig(t, "listen: ':8040'\nttl: 60\nallow-private: true\nstate:\nsection:\n  file: example.db\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"listen": ":8040", "ttl": "60", "allow-private": "true"}
+	if len(c.options) != len(expected) {
+		t.Errorf("unexpected options: %v", c.options)
+	}
+	for key, value := range expected {
+		if c.options[key] != value {
+			t.Errorf("option %s: got %q, want %q", key, c.options[key], value)
+		}
+	}
+
+	if _, err := testConfig(t, "listen: [\n"); err == nil {
+		t.Error("expected error for invalid YAML")
+	}
+	if _, err := NewConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("expected error for missing file")
+	}
+	if c, err := NewConfig(""); err != nil || len(c.options) != 0 {
+		t.Errorf("unexpected result without file: %v, %v", c, err)
+	}
+}
+
+// testSection is a structured configuration section.
+type testSection struct {
+	File        string   `yaml:"file"`
+	Nameservers []string `yaml:"nameservers"`
+}
+
+func TestConfigSection(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+		err      bool
+	}{
+		{"section", "section:\n  file: example.db\n  nameservers: [ns1.example.com]\n", "example.db", false},
+		{"missing", "listen: ':8040'\n", "", false},
+		{"empty", "section:\n", "", false},
+		{"unknown key", "section:\n  file: example.db\n  serial: 1\n", "", true},
+		{"wrong type", "section:\n  file: [example.db]\n", "", true},
+	}
+	for _, test := range tests {
+		c, err := testConfig(t, test.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &testSection{}
+		err = c.Section("section", config)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if config.File != test.expected {
+			t.Errorf("%s: got file %q, want %q", test.name, config.File, test.expected)
+		}
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     bool
+	}{
+		{"known", "listen: ':8040'\nsection:\n  file: example.db\n", false},
+		{"unset", "listen:\n", false},
+		{"unknown option", "listen: ':8040'\nlisten-address: ':8040'\n", true},
+		{"unknown section", "zone:\n  file: example.db\n", true},
+		{"structured option", "listen: [':8040', ':8041']\n", true},
+	}
+	for _, test := range tests {
+		c, err := testConfig(t, test.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Flags are registered with kingpin only once per process.
+		c.flags["listen"] = true
+		if err := c.Section("section", &testSection{}); err != nil {
+			t.Fatal(err)
+		}
+		err = c.Check()
+		if test.err && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		} else if !test.err && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/longsleep/mydyns"
+)
+
+// DatabaseFiles defines the locations of the databases which are loaded
+// together.
+type DatabaseFiles struct {
+	Users    string
+	Hosts    string
+	Security string
+	Admins   string
+}
+
+var reloadlock sync.Mutex
+
+var dbstatus struct {
+	loaded time.Time
+	err    error
+}
+
+// loadDatabases parses and validates all databases and only replaces the
+// active databases if all of them loaded successfully. On error, the
+// previously loaded databases stay active.
+func loadDatabases(files *DatabaseFiles) (err error) {
+	// Serialize loading, so concurrent reloads cannot replace newer data.
+	reloadlock.Lock()
+	defer reloadlock.Unlock()
+
+	defer func() {
+		if err != nil {
+			dblock.Lock()
+			dbstatus.err = err
+			dblock.Unlock()
+		}
+	}()
+
+	u, err := mydyns.NewHtpasswdFile(files.Users)
+	if err != nil {
+		return fmt.Errorf("users database %s: %w", files.Users, err)
+	}
+	h, err := mydyns.NewHostsFile(files.Hosts)
+	if err != nil {
+		return fmt.Errorf("hosts database %s: %w", files.Hosts, err)
+	}
+	s, err := mydyns.NewSecurityFile(files.Security)
+	if err != nil {
+		return fmt.Errorf("security database %s: %w", files.Security, err)
+	}
+	var a *mydyns.HtpasswdFile
+	if files.Admins != "" {
+		if a, err = mydyns.NewHtpasswdFile(files.Admins); err != nil {
+			return fmt.Errorf("admins database %s: %w", files.Admins, err)
+		}
+	}
+	checkDatabases(u, h, s)
+
+	dblock.Lock()
+	users, hosts, security, admins = u, h, s, a
+	dbstatus.loaded = time.Now()
+	dbstatus.err = nil
+	dblock.Unlock()
+
+	return nil
+}
+
+// checkDatabases warns about inconsistencies between the databases.
+func checkDatabases(u *mydyns.HtpasswdFile, h *mydyns.HostsFile, s *mydyns.SecurityFile) {
+	for _, host := range h.Hosts() {
+		entry, _ := h.Users(host)
+		for _, user := range entry {
+			if !u.Exists(user) {
+				log.Printf("Warning: host %s references unknown user %s\n", host, user)
+			}
+		}
+	}
+	for _, user := range s.Users() {
+		if !u.Exists(user) {
+			log.Printf("Warning: security entry for unknown user %s\n", user)
+		}
+	}
+}
+
+// healthHandler reports if the databases are loaded and if the last reload
+// was successful.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	dblock.RLock()
+	loaded := dbstatus.loaded
+	err := dbstatus.err
+	dblock.RUnlock()
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("database reload failed: %s (active since %s)", err, loaded.Format(time.RFC3339)), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintf(w, "ok\n")
+}
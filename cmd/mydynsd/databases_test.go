@@ -0,0 +1,118 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDatabaseFiles writes the given databases into a temporary directory
+// and loads them.
+func testDatabaseFiles(t *testing.T, usersContent, hostsContent, securityContent string) *DatabaseFiles {
+	dir := t.TempDir()
+	files := &DatabaseFiles{
+		Users:    filepath.Join(dir, "users.db"),
+		Hosts:    filepath.Join(dir, "hosts.db"),
+		Security: filepath.Join(dir, "security.db"),
+	}
+	for fn, content := range map[string]string{
+		files.Users:    usersContent,
+		files.Hosts:    hostsContent,
+		files.Security: securityContent,
+	} {
+		if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loadDatabases(files); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestLoadDatabasesKeepsLastGoodCopy(t *testing.T) {
+	const usersContent = "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"
+	const hostsContent = "home:alice\noffice:bob\n"
+	files := testDatabaseFiles(t, usersContent, hostsContent, "alice:alicecode\n")
+
+	health := func() (int, string) {
+		w := httptest.NewRecorder()
+		healthHandler(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		return w.Code, w.Body.String()
+	}
+	if status, _ := health(); status != http.StatusOK {
+		t.Errorf("unexpected health status %d", status)
+	}
+
+	tests := []struct {
+		name    string
+		users   string
+		hosts   string
+		missing bool
+	}{
+		{"host without users", usersContent, "home\n", false},
+		{"duplicate host", usersContent, "home:alice\nhome:bob\n", false},
+		{"invalid users", "alice\n", hostsContent, false},
+		{"missing hosts", usersContent, hostsContent, true},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(files.Users, []byte(test.users), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(files.Hosts, []byte(test.hosts), 0600); err != nil {
+			t.Fatal(err)
+		}
+		broken := *files
+		if test.missing {
+			broken.Hosts += ".missing"
+		}
+		if err := loadDatabases(&broken); err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+		dblock.RLock()
+		ok := hosts.CheckUser("office", "bob")
+		dblock.RUnlock()
+		if !ok {
+			t.Errorf("%s: previous databases replaced", test.name)
+		}
+		if status, body := health(); status != http.StatusServiceUnavailable || !strings.Contains(body, "database reload failed") {
+			t.Errorf("%s: unexpected health %d %q", test.name, status, body)
+		}
+
+		// Loading the fixed databases clears the error.
+		if err := ioutil.WriteFile(files.Users, []byte(usersContent), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(files.Hosts, []byte(hostsContent), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadDatabases(files); err != nil {
+			t.Fatal(err)
+		}
+		if status, _ := health(); status != http.StatusOK {
+			t.Errorf("%s: unexpected health status %d after fix", test.name, status)
+		}
+	}
+}
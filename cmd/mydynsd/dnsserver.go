@@ -0,0 +1,623 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longsleep/mydyns"
+	"github.com/miekg/dns"
+)
+
+// DNSServerConfig defines the embedded DNS server in the dns section of the
+// configuration file.
+type DNSServerConfig struct {
+	SOAConfig   `yaml:",inline"`
+	Listen      string   `yaml:"listen"`
+	Records     []string `yaml:"records"`
+	Secondaries []string `yaml:"secondaries"`
+	Transfer    []string `yaml:"transfer"`
+}
+
+// dnsJournalSize is the number of changes kept for incremental zone
+// transfers.
+const dnsJournalSize = 100
+
+// zoneChange is a change of the zone from one serial to the next.
+type zoneChange struct {
+	from    uint32
+	to      uint32
+	deleted []dns.RR
+	added   []dns.RR
+}
+
+// DNSServer answers authoritative DNS queries for the zone from the records
+// of the hosts, with static records from the configuration. Changes
+// increment the serial of the zone, are kept for incremental zone transfers
+// and are notified to the secondaries.
+type DNSServer struct {
+	sync.RWMutex
+	origin      string
+	ttl         uint32
+	soa         *dns.SOA
+	static      map[string][]dns.RR
+	dynamic     map[string]map[uint16]dns.RR
+	names       map[string]bool
+	journal     []*zoneChange
+	listen      string
+	secondaries []string
+	transfer    []*net.IPNet
+	notify      chan bool
+	servers     []*dns.Server
+}
+
+func NewDNSServer(config *DNSServerConfig, zone string, ttl int, records *RecordStore) (*DNSServer, error) {
+	if config == nil {
+		return nil, errors.New("dns section required")
+	}
+	if err := requireState(records); err != nil {
+		return nil, err
+	}
+	server := &DNSServer{
+		origin:  dns.Fqdn(zone),
+		ttl:     uint32(ttl),
+		static:  make(map[string][]dns.RR),
+		dynamic: make(map[string]map[uint16]dns.RR),
+		listen:  config.Listen,
+		notify:  make(chan bool, 1),
+	}
+	if server.listen == "" {
+		server.listen = ":53"
+	}
+
+	// SOA record, its serial starts with the current time so it increases
+	// across restarts.
+	soa, ns, err := config.records(server.origin, server.ttl)
+	if err != nil {
+		return nil, err
+	}
+	soa.Serial = uint32(time.Now().Unix())
+	server.soa = soa
+
+	// Static records.
+	for _, rr := range ns {
+		server.addStatic(rr)
+	}
+	parser := dns.NewZoneParser(strings.NewReader(strings.Join(config.Records, "\n")), server.origin, "")
+	parser.SetDefaultTTL(server.ttl)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if !dns.IsSubDomain(server.origin, rr.Header().Name) {
+			return nil, fmt.Errorf("record not in zone: %s", rr)
+		}
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return nil, fmt.Errorf("record not allowed: %s", rr)
+		}
+		server.addStatic(rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("invalid records: %w", err)
+	}
+
+	// Secondaries are notified and may transfer the zone.
+	for _, secondary := range config.Secondaries {
+		host, port, err := net.SplitHostPort(secondary)
+		if err != nil {
+			host, port = secondary, "53"
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid secondary address: %s", secondary)
+		}
+		server.secondaries = append(server.secondaries, net.JoinHostPort(host, port))
+		server.transfer = append(server.transfer, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+	}
+	for _, value := range config.Transfer {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid transfer network: %s", value)
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+		}
+		server.transfer = append(server.transfer, network)
+	}
+
+	// Publish the known addresses of all hosts.
+	dblock.RLock()
+	for hostname, addresses := range records.addresses() {
+		if _, ok := hosts.Users(hostname); !ok {
+			continue
+		}
+		wildcard := hosts.Options(hostname).Wildcard
+		for _, ip := range addresses {
+			for _, name := range server.ownerNames(hostname, wildcard) {
+				server.setDynamic(name, ip)
+			}
+		}
+	}
+	dblock.RUnlock()
+	server.updateNames()
+
+	return server, nil
+}
+
+// addStatic adds a static record.
+func (server *DNSServer) addStatic(rr dns.RR) {
+	name := strings.ToLower(rr.Header().Name)
+	rr.Header().Name = name
+	server.static[name] = append(server.static[name], rr)
+}
+
+// ownerNames returns the names of the records of hostname.
+func (server *DNSServer) ownerNames(hostname string, wildcard bool) []string {
+	names := []string{hostname + "." + server.origin}
+	if wildcard {
+		names = append(names, "*."+hostname+"."+server.origin)
+	}
+	return names
+}
+
+// setDynamic sets the address record of name to ip and returns the replaced
+// record, or nil if the record was added. It returns the new record as old
+// record if nothing changed. The caller must hold the lock.
+func (server *DNSServer) setDynamic(name string, ip net.IP) (dns.RR, dns.RR) {
+	rr := addressRecord(name, ip, server.ttl)
+	records, ok := server.dynamic[name]
+	if !ok {
+		records = make(map[uint16]dns.RR)
+		server.dynamic[name] = records
+	}
+	t := rr.Header().Rrtype
+	old := records[t]
+	if old != nil && dns.IsDuplicate(old, rr) {
+		return old, old
+	}
+	records[t] = rr
+	return old, rr
+}
+
+// deleteDynamic removes the address records of name with type t, or all types
+// if t is dns.TypeANY, and returns the removed records. The caller must hold
+// the lock.
+func (server *DNSServer) deleteDynamic(name string, t uint16) []dns.RR {
+	var deleted []dns.RR
+	for rrtype, rr := range server.dynamic[name] {
+		if t == dns.TypeANY || rrtype == t {
+			deleted = append(deleted, rr)
+			delete(server.dynamic[name], rrtype)
+		}
+	}
+	if len(server.dynamic[name]) == 0 {
+		delete(server.dynamic, name)
+	}
+	return deleted
+}
+
+// hostname returns the host of the dynamic record name, for wildcard records
+// the host below which they are.
+func (server *DNSServer) hostname(name string) string {
+	return strings.TrimPrefix(strings.TrimSuffix(name, "."+server.origin), "*.")
+}
+
+// updateNames collects all names which exist in the zone, including empty
+// non-terminals. The caller must hold the lock.
+func (server *DNSServer) updateNames() {
+	names := make(map[string]bool)
+	add := func(name string) {
+		for ; dns.IsSubDomain(server.origin, name) && !names[name]; name = parentName(name) {
+			names[name] = true
+		}
+	}
+	add(server.origin)
+	for name := range server.static {
+		add(name)
+	}
+	for name := range server.dynamic {
+		add(name)
+	}
+	server.names = names
+}
+
+// parentName returns the name without its first label.
+func parentName(name string) string {
+	if idx := strings.Index(name, "."); idx >= 0 && idx < len(name)-1 {
+		return name[idx+1:]
+	}
+	return "."
+}
+
+// process implements Backend. It publishes the records of work with a new
+// serial and notifies the secondaries.
+func (server *DNSServer) process(ctx context.Context, work map[string]*nsUpdateData) error {
+	server.Lock()
+	change := &zoneChange{from: server.soa.Serial}
+
+	// Remove the records of hosts which were deleted from the hosts
+	// database.
+	dblock.RLock()
+	for name := range server.dynamic {
+		if _, ok := hosts.Users(server.hostname(name)); !ok {
+			change.deleted = append(change.deleted, server.deleteDynamic(name, dns.TypeANY)...)
+		}
+	}
+	dblock.RUnlock()
+
+	for _, data := range work {
+		if !mydyns.ValidHostname(data.hostname) {
+			log.Println("Skipping update of invalid hostname", data.hostname)
+			continue
+		}
+		for _, name := range server.ownerNames(data.hostname, data.wildcard) {
+			old, rr := server.setDynamic(name, *data.ip)
+			if old == rr {
+				continue
+			}
+			if old != nil {
+				change.deleted = append(change.deleted, old)
+			}
+			change.added = append(change.added, rr)
+		}
+		if !data.wildcard {
+			// Names below the host no longer follow it.
+			name := "*." + data.hostname + "." + server.origin
+			change.deleted = append(change.deleted, server.deleteDynamic(name, dns.StringToType[recordType(*data.ip)])...)
+		}
+	}
+	if len(change.added) == 0 && len(change.deleted) == 0 {
+		server.Unlock()
+		return nil
+	}
+	// The SOA is replaced instead of changed, as it is used outside of the
+	// lock by running zone transfers.
+	soa := dns.Copy(server.soa).(*dns.SOA)
+	soa.Serial++
+	server.soa = soa
+	change.to = server.soa.Serial
+	server.journal = append(server.journal, change)
+	if len(server.journal) > dnsJournalSize {
+		server.journal = server.journal[len(server.journal)-dnsJournalSize:]
+	}
+	server.updateNames()
+	server.Unlock()
+	log.Printf("Zone %s changed to serial %d\n", server.origin, change.to)
+
+	// Notify without blocking, pending notifications are merged.
+	select {
+	case server.notify <- true:
+	default:
+	}
+	return nil
+}
+
+// lookup returns the records of name with type qtype, and whether the name
+// exists. Wildcard records are returned with name as owner. The caller must
+// hold the read lock.
+func (server *DNSServer) lookup(name string, qtype uint16) ([]dns.RR, bool) {
+	owner := name
+	if !server.names[name] {
+		// Names which do not exist are answered from the wildcard of their
+		// closest existing ancestor.
+		owner = ""
+		for parent := parentName(name); dns.IsSubDomain(server.origin, parent); parent = parentName(parent) {
+			if server.names[parent] {
+				if server.names["*."+parent] {
+					owner = "*." + parent
+				}
+				break
+			}
+		}
+		if owner == "" {
+			return nil, false
+		}
+	}
+
+	var result, cnames []dns.RR
+	for _, rr := range server.records(owner) {
+		t := rr.Header().Rrtype
+		if t == dns.TypeCNAME && qtype != dns.TypeCNAME && qtype != dns.TypeANY {
+			cnames = append(cnames, rr)
+			continue
+		}
+		if qtype == dns.TypeANY || t == qtype {
+			result = append(result, rr)
+		}
+	}
+	if len(result) == 0 {
+		// Names with a CNAME record have no other records.
+		result = cnames
+	}
+	if owner != name {
+		for idx, rr := range result {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			result[idx] = rr
+		}
+	}
+	return result, true
+}
+
+// records returns all records of name. The caller must hold the read lock.
+func (server *DNSServer) records(name string) []dns.RR {
+	var result []dns.RR
+	if name == server.origin {
+		result = append(result, dns.Copy(server.soa))
+	}
+	result = append(result, server.static[name]...)
+	types := make([]int, 0, len(server.dynamic[name]))
+	for t := range server.dynamic[name] {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		result = append(result, server.dynamic[name][uint16(t)])
+	}
+	return result
+}
+
+// ServeDNS implements dns.Handler.
+func (server *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	msg := new(dns.Msg)
+	switch {
+	case r.Opcode != dns.OpcodeQuery:
+		msg.SetRcode(r, dns.RcodeNotImplemented)
+		w.WriteMsg(msg)
+		return
+	case len(r.Question) != 1:
+		msg.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(msg)
+		return
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(server.origin, name) || (q.Qclass != dns.ClassINET && q.Qclass != dns.ClassANY) {
+		msg.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(msg)
+		return
+	}
+
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		server.serveTransfer(w, r)
+		return
+	}
+
+	msg.SetReply(r)
+	msg.Authoritative = true
+	server.RLock()
+	answer, exists := server.lookup(name, q.Qtype)
+	if len(answer) > 0 {
+		msg.Answer = answer
+	} else {
+		// NXDOMAIN and NODATA responses have the SOA for negative caching.
+		if !exists {
+			msg.Rcode = dns.RcodeNameError
+		}
+		soa := dns.Copy(server.soa).(*dns.SOA)
+		soa.Hdr.Ttl = soa.Minttl
+		msg.Ns = []dns.RR{soa}
+	}
+	server.RUnlock()
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+		msg.SetEdns0(opt.UDPSize(), false)
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		msg.Truncate(size)
+	}
+	w.WriteMsg(msg)
+}
+
+// serveTransfer answers AXFR and IXFR requests of allowed clients. Over UDP,
+// only the current SOA is returned to make the client use TCP.
+func (server *DNSServer) serveTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	msg := new(dns.Msg)
+	if !server.transferAllowed(w.RemoteAddr()) {
+		log.Println("Refused zone transfer to", w.RemoteAddr())
+		msg.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(msg)
+		return
+	}
+
+	server.RLock()
+	soa := dns.Copy(server.soa)
+	var rrs []dns.RR
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		server.RUnlock()
+		if r.Question[0].Qtype == dns.TypeAXFR {
+			msg.SetRcode(r, dns.RcodeRefused)
+		} else {
+			msg.SetReply(r)
+			msg.Authoritative = true
+			msg.Answer = []dns.RR{soa}
+		}
+		w.WriteMsg(msg)
+		return
+	}
+	if r.Question[0].Qtype == dns.TypeIXFR {
+		rrs = server.incremental(r)
+	}
+	if rrs == nil {
+		rrs = server.full()
+	}
+	server.RUnlock()
+	log.Printf("Zone transfer of serial %d to %s\n", soa.(*dns.SOA).Serial, w.RemoteAddr())
+
+	ch := make(chan *dns.Envelope)
+	go func() {
+		for len(rrs) > 0 {
+			n := 100
+			if n > len(rrs) {
+				n = len(rrs)
+			}
+			ch <- &dns.Envelope{RR: rrs[:n]}
+			rrs = rrs[n:]
+		}
+		close(ch)
+	}()
+	transfer := new(dns.Transfer)
+	if err := transfer.Out(w, r, ch); err != nil {
+		log.Println("Zone transfer failed", w.RemoteAddr(), err)
+		for range ch {
+		}
+	}
+	w.Close()
+}
+
+// full returns the records of a full zone transfer. The caller must hold the
+// read lock.
+func (server *DNSServer) full() []dns.RR {
+	names := make([]string, 0, len(server.names))
+	for name := range server.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	soa := dns.Copy(server.soa)
+	rrs := []dns.RR{soa}
+	for _, name := range names {
+		for _, rr := range server.records(name) {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return append(rrs, soa)
+}
+
+// incremental returns the records of an incremental zone transfer from the
+// serial of the client in r, or nil if the journal does not reach back to
+// it. The caller must hold the read lock.
+func (server *DNSServer) incremental(r *dns.Msg) []dns.RR {
+	if len(r.Ns) != 1 {
+		return nil
+	}
+	client, ok := r.Ns[0].(*dns.SOA)
+	if !ok {
+		return nil
+	}
+	soa := dns.Copy(server.soa)
+	if !serialAfter(server.soa.Serial, client.Serial) {
+		// Client is up to date.
+		return []dns.RR{soa}
+	}
+	for idx, change := range server.journal {
+		if change.from != client.Serial {
+			continue
+		}
+		rrs := []dns.RR{soa}
+		for _, change := range server.journal[idx:] {
+			from := dns.Copy(server.soa).(*dns.SOA)
+			from.Serial = change.from
+			to := dns.Copy(server.soa).(*dns.SOA)
+			to.Serial = change.to
+			rrs = append(rrs, from)
+			rrs = append(rrs, change.deleted...)
+			rrs = append(rrs, to)
+			rrs = append(rrs, change.added...)
+		}
+		return append(rrs, soa)
+	}
+	return nil
+}
+
+// transferAllowed checks if addr may transfer the zone.
+func (server *DNSServer) transferAllowed(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	for _, network := range server.transfer {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// start listens for UDP and TCP queries.
+func (server *DNSServer) start() error {
+	conn, err := net.ListenPacket("udp", server.listen)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", server.listen)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	server.servers = []*dns.Server{
+		{PacketConn: conn, Handler: server},
+		{Listener: listener, Handler: server},
+	}
+	for _, s := range server.servers {
+		go func(s *dns.Server) {
+			if err := s.ActivateAndServe(); err != nil {
+				log.Println("DNS server failed", err)
+			}
+		}(s)
+	}
+	go server.run()
+	log.Printf("DNS server for %s listening on: %s\n", server.origin, server.listen)
+	return nil
+}
+
+// shutdown stops answering queries.
+func (server *DNSServer) shutdown(ctx context.Context) {
+	for _, s := range server.servers {
+		if err := s.ShutdownContext(ctx); err != nil {
+			log.Println("DNS server shutdown failed", err)
+		}
+	}
+}
+
+// run sends NOTIFY messages to the secondaries after changes.
+func (server *DNSServer) run() {
+	client := &dns.Client{Timeout: 5 * time.Second}
+	for range server.notify {
+		msg := new(dns.Msg)
+		msg.SetNotify(server.origin)
+		server.RLock()
+		msg.Answer = []dns.RR{dns.Copy(server.soa)}
+		server.RUnlock()
+		for _, secondary := range server.secondaries {
+			var err error
+			for attempt := 0; attempt < 3; attempt++ {
+				if _, _, err = client.Exchange(msg, secondary); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				log.Println("Notify failed", secondary, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestDNSServer(t *testing.T, records *RecordStore) *DNSServer {
+	config := &DNSServerConfig{
+		SOAConfig: SOAConfig{Nameservers: []string{"ns1.example.com"}},
+		Records:   []string{"www CNAME home"},
+	}
+	server, err := NewDNSServer(config, "dyn.example.com", 60, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// testLookup returns the addresses of name.
+func testLookup(server *DNSServer, name string) []string {
+	server.RLock()
+	defer server.RUnlock()
+	rrs, _ := server.lookup(name, dns.TypeANY)
+	var result []string
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			result = append(result, rr.A.String())
+		case *dns.AAAA:
+			result = append(result, rr.AAAA.String())
+		}
+	}
+	return result
+}
+
+func TestDNSServerStartup(t *testing.T) {
+	testDatabaseFiles(t, testUsers, "home:alice\n", "")
+	records := testRecordStore(t, testUpdate("home", "203.0.113.5", false), testUpdate("deleted", "203.0.113.6", false))
+	server := newTestDNSServer(t, records)
+
+	if addresses := testLookup(server, "home.dyn.example.com."); len(addresses) != 1 || addresses[0] != "203.0.113.5" {
+		t.Errorf("unexpected addresses of home: %v", addresses)
+	}
+	if addresses := testLookup(server, "deleted.dyn.example.com."); len(addresses) != 0 {
+		t.Errorf("deleted host should not be published: %v", addresses)
+	}
+}
+
+func TestDNSServerProcess(t *testing.T) {
+	files := testDatabaseFiles(t, testUsers, "home:alice:wildcard\noffice:bob\n", "")
+	server := newTestDNSServer(t, testRecordStore(t))
+	serial := server.soa.Serial
+
+	steps := []struct {
+		name     string
+		hosts    string
+		update   *nsUpdateData
+		expected map[string]int
+	}{
+		{"wildcard", "", testUpdate("home", "203.0.113.5", true), map[string]int{
+			"home.dyn.example.com.":     1,
+			"sub.home.dyn.example.com.": 1,
+		}},
+		{"second host", "", testUpdate("office", "2001:db8::1", false), map[string]int{
+			"home.dyn.example.com.":     1,
+			"sub.home.dyn.example.com.": 1,
+			"office.dyn.example.com.":   1,
+		}},
+		{"wildcard removed", "home:alice\noffice:bob\n", testUpdate("home", "203.0.113.7", false), map[string]int{
+			"home.dyn.example.com.":     1,
+			"sub.home.dyn.example.com.": 0,
+			"office.dyn.example.com.":   1,
+		}},
+		{"host deleted", "home:alice\n", testUpdate("home", "2001:db8::7", false), map[string]int{
+			"home.dyn.example.com.":   2,
+			"office.dyn.example.com.": 0,
+		}},
+	}
+	for _, step := range steps {
+		if step.hosts != "" {
+			if err := ioutil.WriteFile(files.Hosts, []byte(step.hosts), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadDatabases(files); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := server.process(context.Background(), testWork(step.update)); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		for name, count := range step.expected {
+			if addresses := testLookup(server, name); len(addresses) != count {
+				t.Errorf("%s: expected %d addresses of %s, got %v", step.name, count, name, addresses)
+			}
+		}
+		serial++
+		if server.soa.Serial != serial {
+			t.Errorf("%s: serial %d, want %d", step.name, server.soa.Serial, serial)
+		}
+	}
+
+	// Deletions are part of the journal for incremental transfers.
+	last := server.journal[len(server.journal)-1]
+	if len(last.deleted) != 1 || len(last.added) != 1 {
+		t.Errorf("unexpected last change: deleted %v, added %v", last.deleted, last.added)
+	}
+
+	// Nothing changed, the serial stays.
+	if err := server.process(context.Background(), testWork(testUpdate("home", "2001:db8::7", false))); err != nil {
+		t.Fatal(err)
+	}
+	if server.soa.Serial != serial {
+		t.Error("serial changed without changes")
+	}
+}
+
+func TestDNSServerSOACopies(t *testing.T) {
+	testDatabaseFiles(t, testUsers, "home:alice\n", "")
+	server := newTestDNSServer(t, testRecordStore(t))
+
+	// Records are used outside of the lock, while updates change the serial.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			server.RLock()
+			rrs := server.full()
+			answer, _ := server.lookup(server.origin, dns.TypeSOA)
+			server.RUnlock()
+			_ = rrs[0].(*dns.SOA).Serial + answer[0].(*dns.SOA).Serial
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		ip := net.IPv4(203, 0, 113, byte(i))
+		if err := server.process(context.Background(), testWork(&nsUpdateData{"home", &ip, "", "alice", false})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	server.RLock()
+	soa := server.full()[0]
+	server.RUnlock()
+	if soa == dns.RR(server.soa) {
+		t.Error("full transfer returns the shared SOA")
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// HostsFileConfig defines the hosts file backend in the hostsfile section of
+// the configuration file.
+type HostsFileConfig struct {
+	File    string   `yaml:"file"`
+	PIDFile string   `yaml:"pidfile"`
+	Reload  []string `yaml:"reload"`
+}
+
+// HostsFileBackend writes the addresses of all hosts into a file in
+// /etc/hosts format, like an addn-hosts file of dnsmasq, and makes the DNS
+// server reload it.
+type HostsFileBackend struct {
+	origin  string
+	pidfile string
+	records *RecordStore
+	generatedFile
+}
+
+func NewHostsFileBackend(config *HostsFileConfig, zone string, records *RecordStore) (*HostsFileBackend, error) {
+	if config == nil {
+		return nil, errors.New("hostsfile section required")
+	}
+	if config.File == "" {
+		return nil, errors.New("file required")
+	}
+	if err := requireState(records); err != nil {
+		return nil, err
+	}
+	return &HostsFileBackend{
+		origin:  zone,
+		pidfile: config.PIDFile,
+		records: records,
+		generatedFile: generatedFile{
+			file:   config.File,
+			reload: config.Reload,
+		},
+	}, nil
+}
+
+// process implements Backend. It writes the hosts file with the addresses of
+// all hosts including work, and signals the DNS server if anything changed.
+func (hf *HostsFileBackend) process(ctx context.Context, work map[string]*nsUpdateData) error {
+	addresses := currentAddresses(hf.records, work)
+	hostnames := validHostnames(addresses)
+
+	var data bytes.Buffer
+	fmt.Fprintf(&data, "# Hosts of %s generated by mydynsd, do not edit.\n", hf.origin)
+	for _, hostname := range hostnames {
+		for _, t := range []string{"A", "AAAA"} {
+			for _, ip := range addresses[hostname] {
+				if recordType(ip) == t {
+					fmt.Fprintf(&data, "%s\t%s.%s\n", ip, hostname, hf.origin)
+				}
+			}
+		}
+	}
+	if hf.unchanged(data.Bytes()) {
+		return nil
+	}
+	return hf.publish(ctx, data.Bytes(), data.Bytes(), func() error {
+		log.Printf("Wrote hosts file %s with %d hosts\n", hf.file, len(hostnames))
+		if hf.pidfile != "" {
+			if err := hf.signal(); err != nil {
+				return fmt.Errorf("reload failed: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// signal sends SIGHUP to the process in the pid file, which makes dnsmasq
+// read its hosts files again.
+func (hf *HostsFileBackend) signal() error {
+	pid, err := readPIDFile(hf.pidfile)
+	if err != nil {
+		return err
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(syscall.SIGHUP)
+}
+
+// readPIDFile returns the process ID in the pid file fn.
+func readPIDFile(fn string) (int, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid file %s", fn)
+	}
+	return pid, nil
+}
@@ -0,0 +1,155 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestReadPIDFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		content  string
+		expected int
+		err      bool
+	}{
+		{"pid", "1234", 1234, false},
+		{"newline", " 1234\n", 1234, false},
+		{"empty", "", 0, true},
+		{"zero", "0\n", 0, true},
+		{"negative", "-1\n", 0, true},
+		{"not a number", "dnsmasq\n", 0, true},
+	}
+	for _, test := range tests {
+		fn := filepath.Join(dir, "dnsmasq.pid")
+		if err := ioutil.WriteFile(fn, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		pid, err := readPIDFile(fn)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if pid != test.expected {
+			t.Errorf("%s: got %d, want %d", test.name, pid, test.expected)
+		}
+	}
+	if _, err := readPIDFile(filepath.Join(dir, "missing.pid")); err == nil {
+		t.Error("expected error for missing pid file")
+	}
+}
+
+func TestHostsFileProcess(t *testing.T) {
+	files := testDatabaseFiles(t, testUsers, "home:alice:wildcard\noffice:bob\n", "")
+	records := testRecordStore(t, testUpdate("office", "203.0.113.6", false))
+	dir := filepath.Dir(records.file)
+	hf, err := NewHostsFileBackend(&HostsFileConfig{File: filepath.Join(dir, "dnsmasq.hosts")}, "dyn.example.com", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name     string
+		hosts    string
+		update   *nsUpdateData
+		expected string
+	}{
+		{"new host", "", testUpdate("home", "2001:db8::5", true), "# Hosts of dyn.example.com generated by mydynsd, do not edit.\n" +
+			"2001:db8::5\thome.dyn.example.com\n" +
+			"203.0.113.6\toffice.dyn.example.com\n"},
+		{"second address", "", testUpdate("home", "203.0.113.5", true), "# Hosts of dyn.example.com generated by mydynsd, do not edit.\n" +
+			"203.0.113.5\thome.dyn.example.com\n" +
+			"2001:db8::5\thome.dyn.example.com\n" +
+			"203.0.113.6\toffice.dyn.example.com\n"},
+		{"host deleted", "home:alice\n", testUpdate("home", "203.0.113.7", false), "# Hosts of dyn.example.com generated by mydynsd, do not edit.\n" +
+			"203.0.113.7\thome.dyn.example.com\n" +
+			"2001:db8::5\thome.dyn.example.com\n"},
+	}
+	for _, step := range steps {
+		if step.hosts != "" {
+			if err := ioutil.WriteFile(files.Hosts, []byte(step.hosts), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadDatabases(files); err != nil {
+				t.Fatal(err)
+			}
+		}
+		work := testWork(step.update)
+		if err := hf.process(context.Background(), work); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		records.applied(work)
+		if data, _ := ioutil.ReadFile(hf.file); string(data) != step.expected {
+			t.Errorf("%s: unexpected hosts file:\n%s", step.name, data)
+		}
+	}
+
+	// Nothing changed, the file is not written again.
+	if err := ioutil.WriteFile(hf.file, []byte("unchanged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := hf.process(context.Background(), testWork(testUpdate("home", "203.0.113.7", false))); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(hf.file); string(data) != "unchanged" {
+		t.Error("hosts file written without changes")
+	}
+}
+
+func TestHostsFileSignal(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skip("sleep not available:", err)
+	}
+	defer cmd.Process.Kill()
+
+	records := testRecordStore(t)
+	dir := filepath.Dir(records.file)
+	config := &HostsFileConfig{
+		File:    filepath.Join(dir, "dnsmasq.hosts"),
+		PIDFile: filepath.Join(dir, "dnsmasq.pid"),
+	}
+	if err := ioutil.WriteFile(config.PIDFile, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hf, err := NewHostsFileBackend(config, "dyn.example.com", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDatabaseFiles(t, testUsers, testHosts, "")
+	if err := hf.process(context.Background(), testWork(testUpdate("home", "203.0.113.5", false))); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || !status.Signaled() || status.Signal() != syscall.SIGHUP {
+		t.Errorf("process not signaled with SIGHUP: %v", cmd.ProcessState)
+	}
+}
@@ -0,0 +1,315 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/longsleep/mydyns"
+)
+
+// tokenBucket holds the available requests of a single key.
+type tokenBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// authFailures counts failed authentications of a client address and user.
+type authFailures struct {
+	Count int       `json:"count"`
+	Last  time.Time `json:"last"`
+	Until time.Time `json:"until"`
+}
+
+// rateLimit is a token bucket rate limit, allowing burst requests which are
+// refilled over interval.
+type rateLimit struct {
+	burst    float64
+	interval time.Duration
+}
+
+// parseRateLimit parses a rate limit like 30/1m. An empty value or 0
+// disables the limit and returns nil.
+func parseRateLimit(value string) (*rateLimit, error) {
+	if value == "" || value == "0" {
+		return nil, nil
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid rate limit %s, use requests/duration", value)
+	}
+	burst, err := strconv.Atoi(parts[0])
+	if err != nil || burst < 1 {
+		return nil, fmt.Errorf("invalid rate limit %s: invalid number of requests", value)
+	}
+	interval, err := time.ParseDuration(parts[1])
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %s: invalid duration", value)
+	}
+	return &rateLimit{float64(burst), interval}, nil
+}
+
+// retryAfter returns the value of the Retry-After header for the duration
+// retry or an empty string.
+func retryAfter(retry time.Duration) string {
+	if retry <= 0 {
+		return ""
+	}
+	return strconv.Itoa(int(math.Ceil(retry.Seconds())))
+}
+
+// LimitsConfig defines the rate limits and the lockout after failed
+// authentications.
+type LimitsConfig struct {
+	IP       string
+	User     string
+	Host     string
+	Failures int
+	Lockout  time.Duration
+	File     string
+}
+
+// Limits implements rate limits per client address, user and host, and locks
+// out clients after repeated failed authentications. The state is kept in
+// memory and optionally saved to a file.
+type Limits struct {
+	sync.Mutex
+	limits   map[string]*rateLimit
+	failures int
+	lockout  time.Duration
+	file     string
+	dirty    bool
+	state    struct {
+		Buckets  map[string]*tokenBucket  `json:"buckets"`
+		Failures map[string]*authFailures `json:"failures"`
+	}
+}
+
+func NewLimits(config *LimitsConfig) (*Limits, error) {
+	limits := &Limits{
+		limits:   make(map[string]*rateLimit),
+		failures: config.Failures,
+		lockout:  config.Lockout,
+		file:     config.File,
+	}
+	limits.state.Buckets = make(map[string]*tokenBucket)
+	limits.state.Failures = make(map[string]*authFailures)
+	for kind, value := range map[string]string{"ip": config.IP, "user": config.User, "host": config.Host} {
+		limit, err := parseRateLimit(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", kind, err)
+		}
+		if limit != nil {
+			limits.limits[kind] = limit
+		}
+	}
+
+	if limits.file != "" {
+		data, err := ioutil.ReadFile(limits.file)
+		switch {
+		case err == nil:
+			if err = json.Unmarshal(data, &limits.state); err != nil {
+				return nil, fmt.Errorf("%s: %w", limits.file, err)
+			}
+			if limits.state.Buckets == nil {
+				limits.state.Buckets = make(map[string]*tokenBucket)
+			}
+			if limits.state.Failures == nil {
+				limits.state.Failures = make(map[string]*authFailures)
+			}
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+	return limits, nil
+}
+
+// allow takes a request from the buckets of keys of the given kind (ip,
+// user or host). Requests are only taken when all keys allow them, otherwise
+// it returns false and the duration until the next request is allowed.
+func (limits *Limits) allow(kind string, keys ...string) (bool, time.Duration) {
+	limit, ok := limits.limits[kind]
+	if !ok {
+		return true, 0
+	}
+	now := time.Now()
+	limits.Lock()
+	defer limits.Unlock()
+
+	buckets := make(map[string]*tokenBucket)
+	allowed := true
+	var retry time.Duration
+	for _, key := range keys {
+		id := kind + " " + key
+		bucket, ok := limits.state.Buckets[id]
+		if !ok {
+			bucket = &tokenBucket{limit.burst, now}
+			limits.state.Buckets[id] = bucket
+		}
+		// Refill for the elapsed time.
+		bucket.Tokens += now.Sub(bucket.Updated).Seconds() * limit.burst / limit.interval.Seconds()
+		if bucket.Tokens > limit.burst {
+			bucket.Tokens = limit.burst
+		}
+		bucket.Updated = now
+		limits.dirty = true
+
+		if bucket.Tokens < 1 {
+			allowed = false
+			missing := time.Duration((1 - bucket.Tokens) * limit.interval.Seconds() / limit.burst * float64(time.Second))
+			if missing > retry {
+				retry = missing
+			}
+		}
+		buckets[id] = bucket
+	}
+	if !allowed {
+		return false, retry
+	}
+	for _, bucket := range buckets {
+		bucket.Tokens--
+	}
+	return true, 0
+}
+
+// failureKey returns the key of failed authentications of user from client.
+// Without user, failures are counted for the client address alone.
+func failureKey(client, user string) string {
+	if user == "" {
+		return client
+	}
+	return client + " " + user
+}
+
+// locked checks if user is locked out for client, either for the user or for
+// the client address, and returns the remaining duration.
+func (limits *Limits) locked(client, user string) (bool, time.Duration) {
+	limits.Lock()
+	defer limits.Unlock()
+	var locked time.Duration
+	for _, key := range []string{failureKey(client, ""), failureKey(client, user)} {
+		if failures, ok := limits.state.Failures[key]; ok {
+			if remaining := time.Until(failures.Until); remaining > locked {
+				locked = remaining
+			}
+		}
+	}
+	return locked > 0, locked
+}
+
+// failed counts a failed authentication of user from client and locks them
+// out, when the allowed number of failures is reached. Callers pass an empty
+// user for unknown users and invalid tokens, so only the client address is
+// counted and the state cannot grow with made up user names.
+func (limits *Limits) failed(client, user string) {
+	if limits.failures <= 0 || limits.lockout <= 0 {
+		return
+	}
+	now := time.Now()
+	key := failureKey(client, user)
+	limits.Lock()
+	defer limits.Unlock()
+
+	failures, ok := limits.state.Failures[key]
+	if !ok || now.Sub(failures.Last) > limits.lockout {
+		// Failures expire after the lockout duration.
+		failures = &authFailures{}
+		limits.state.Failures[key] = failures
+	}
+	failures.Count++
+	failures.Last = now
+	if failures.Count >= limits.failures {
+		failures.Until = now.Add(limits.lockout)
+		failures.Count = 0
+		log.Printf("Locking out %s for %s after repeated authentication failures\n", key, limits.lockout)
+	}
+	limits.dirty = true
+}
+
+// succeeded resets the failed authentications of user from client.
+func (limits *Limits) succeeded(client, user string) {
+	key := failureKey(client, user)
+	limits.Lock()
+	defer limits.Unlock()
+	if _, ok := limits.state.Failures[key]; ok {
+		delete(limits.state.Failures, key)
+		limits.dirty = true
+	}
+}
+
+// expire removes full buckets and expired failures.
+func (limits *Limits) expire() {
+	now := time.Now()
+	limits.Lock()
+	defer limits.Unlock()
+	for id, bucket := range limits.state.Buckets {
+		limit, ok := limits.limits[strings.SplitN(id, " ", 2)[0]]
+		if !ok || now.Sub(bucket.Updated) > limit.interval {
+			delete(limits.state.Buckets, id)
+			limits.dirty = true
+		}
+	}
+	for key, failures := range limits.state.Failures {
+		if now.Sub(failures.Last) > limits.lockout && now.After(failures.Until) {
+			delete(limits.state.Failures, key)
+			limits.dirty = true
+		}
+	}
+}
+
+// save writes the state to the file of the limits, if changed.
+func (limits *Limits) save() error {
+	if limits.file == "" {
+		return nil
+	}
+	limits.Lock()
+	defer limits.Unlock()
+	if !limits.dirty {
+		return nil
+	}
+	data, err := json.Marshal(&limits.state)
+	if err != nil {
+		return err
+	}
+	if err = mydyns.WriteFileAtomic(limits.file, data, 0600); err != nil {
+		return err
+	}
+	limits.dirty = false
+	return nil
+}
+
+// run expires and saves the state regularly.
+func (limits *Limits) run() {
+	for range time.Tick(time.Minute) {
+		limits.expire()
+		if err := limits.save(); err != nil {
+			log.Println("Failed to save limits", err)
+		}
+	}
+}
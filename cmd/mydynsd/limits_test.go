@@ -0,0 +1,175 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value    string
+		burst    float64
+		interval time.Duration
+		err      bool
+	}{
+		{"", 0, 0, false},
+		{"0", 0, 0, false},
+		{"30/1m", 30, time.Minute, false},
+		{"1/10s", 1, 10 * time.Second, false},
+		{"30", 0, 0, true},
+		{"0/1m", 0, 0, true},
+		{"-1/1m", 0, 0, true},
+		{"x/1m", 0, 0, true},
+		{"30/x", 0, 0, true},
+		{"30/0s", 0, 0, true},
+		{"30/-1m", 0, 0, true},
+	}
+	for _, test := range tests {
+		limit, err := parseRateLimit(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.value, err)
+			continue
+		}
+		if test.burst == 0 {
+			if limit != nil {
+				t.Errorf("%q: expected no limit", test.value)
+			}
+			continue
+		}
+		if limit == nil || limit.burst != test.burst || limit.interval != test.interval {
+			t.Errorf("%q: unexpected limit %+v", test.value, limit)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		retry    time.Duration
+		expected string
+	}{
+		{0, ""},
+		{-time.Second, ""},
+		{time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+	}
+	for _, test := range tests {
+		if value := retryAfter(test.retry); value != test.expected {
+			t.Errorf("retryAfter(%s) = %q, want %q", test.retry, value, test.expected)
+		}
+	}
+}
+
+func TestLimitsAllow(t *testing.T) {
+	limits, err := NewLimits(&LimitsConfig{IP: "3/1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := limits.allow("ip", "203.0.113.1"); !ok {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+	ok, retry := limits.allow("ip", "203.0.113.1")
+	if ok || retry <= 0 || retry > 20*time.Minute {
+		t.Errorf("request over burst should be limited, got %v %s", ok, retry)
+	}
+	if ok, _ := limits.allow("ip", "203.0.113.2"); !ok {
+		t.Error("other addresses should not be limited")
+	}
+	if ok, _ := limits.allow("user", "alice"); !ok {
+		t.Error("kinds without limit should not be limited")
+	}
+
+	// Buckets refill over the interval.
+	limits.state.Buckets["ip 203.0.113.1"].Updated = time.Now().Add(-20 * time.Minute)
+	if ok, _ := limits.allow("ip", "203.0.113.1"); !ok {
+		t.Error("request should be allowed after refill")
+	}
+}
+
+func TestLimitsAllowSeveral(t *testing.T) {
+	limits, err := NewLimits(&LimitsConfig{Host: "2/1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _ := limits.allow("host", "office"); !ok {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+	if ok, retry := limits.allow("host", "home", "office"); ok || retry <= 0 {
+		t.Errorf("request should be limited by any host, got %v %s", ok, retry)
+	}
+	// Nothing was taken from the hosts of the rejected request.
+	if tokens := limits.state.Buckets["host home"].Tokens; tokens != 2 {
+		t.Errorf("rejected request took from other hosts, %v tokens left", tokens)
+	}
+	if ok, _ := limits.allow("host", "home", "home"); !ok {
+		t.Error("request should be allowed")
+	}
+}
+
+func TestLimitsLockout(t *testing.T) {
+	limits, err := NewLimits(&LimitsConfig{Failures: 2, Lockout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits.failed("203.0.113.1", "alice")
+	if locked, _ := limits.locked("203.0.113.1", "alice"); locked {
+		t.Fatal("locked out after first failure")
+	}
+	limits.failed("203.0.113.1", "alice")
+
+	tests := []struct {
+		client, user string
+		locked       bool
+	}{
+		{"203.0.113.1", "alice", true},
+		{"203.0.113.2", "alice", false},
+		{"203.0.113.1", "bob", false},
+		{"203.0.113.1", "", false},
+	}
+	for _, test := range tests {
+		if locked, _ := limits.locked(test.client, test.user); locked != test.locked {
+			t.Errorf("%s %s: locked = %v, want %v", test.client, test.user, locked, test.locked)
+		}
+	}
+
+	// Failures without user lock out the client address for everyone.
+	limits.failed("203.0.113.3", "")
+	limits.failed("203.0.113.3", "")
+	if locked, retry := limits.locked("203.0.113.3", "bob"); !locked || retry <= 0 {
+		t.Error("client address should be locked out")
+	}
+
+	limits.succeeded("203.0.113.1", "alice")
+	if locked, _ := limits.locked("203.0.113.1", "alice"); locked {
+		t.Error("lockout should be reset after success")
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Default templates of notification emails. Templates start with headers,
+// followed by an empty line and the body.
+const (
+	defaultChangedTemplate = `Subject: {{.Host}} changed to {{.New}}
+
+Hello {{.Recipient}},
+
+the {{.Family}} address of {{.FQDN}} changed{{if .Old}} from {{.Old}}{{end}} to {{.New}}
+at {{.Time.Format "2006-01-02 15:04:05 MST"}}.
+`
+	defaultFailedTemplate = `Subject: Updates of {{.Host}} are failing
+
+Hello {{.Recipient}},
+
+updating the {{.Family}} address of {{.FQDN}} to {{.New}} failed {{.Failures}} times,
+last at {{.Time.Format "2006-01-02 15:04:05 MST"}}:
+
+{{.Error}}
+`
+)
+
+// SMTPConfig defines the smtp section of the configuration file.
+type SMTPConfig struct {
+	Host      string `yaml:"host"`
+	Port      int    `yaml:"port"`
+	StartTLS  bool   `yaml:"starttls"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	From      string `yaml:"from"`
+	Changes   *bool  `yaml:"changes"`
+	Failures  *int   `yaml:"failures"`
+	Templates struct {
+		Changed string `yaml:"changed"`
+		Failed  string `yaml:"failed"`
+	} `yaml:"templates"`
+}
+
+// changedMail is the data of templates for address changes.
+type changedMail struct {
+	*addressChange
+	Recipient string
+	FQDN      string
+}
+
+// failedMail is the data of templates for failed updates.
+type failedMail struct {
+	*addressFailure
+	Recipient string
+	FQDN      string
+}
+
+// mailMessage is a queued email.
+type mailMessage struct {
+	to   string
+	data []byte
+}
+
+// Mailer notifies users by email about changes of the addresses of their
+// hosts and about failing updates. Users without email address are skipped.
+type Mailer struct {
+	config          *SMTPConfig
+	zone            string
+	from            *mail.Address
+	changes         bool
+	failures        int
+	changedTemplate *template.Template
+	failedTemplate  *template.Template
+	queue           chan *mailMessage
+}
+
+func NewMailer(config *SMTPConfig, zone string) (*Mailer, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("smtp host required")
+	}
+	if config.Port == 0 {
+		config.Port = 25
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid smtp from address: %w", err)
+	}
+
+	mailer := &Mailer{
+		config:   config,
+		zone:     zone,
+		from:     from,
+		changes:  true,
+		failures: 3,
+		queue:    make(chan *mailMessage, 100),
+	}
+	if config.Changes != nil {
+		mailer.changes = *config.Changes
+	}
+	if config.Failures != nil {
+		mailer.failures = *config.Failures
+	}
+	if mailer.changedTemplate, err = loadMailTemplate("changed", config.Templates.Changed, defaultChangedTemplate); err != nil {
+		return nil, err
+	}
+	if mailer.failedTemplate, err = loadMailTemplate("failed", config.Templates.Failed, defaultFailedTemplate); err != nil {
+		return nil, err
+	}
+	return mailer, nil
+}
+
+// loadMailTemplate parses the template file fn or text if fn is empty.
+func loadMailTemplate(name, fn, text string) (*template.Template, error) {
+	if fn != "" {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("%s template: %w", name, err)
+		}
+		text = string(data)
+	}
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s template: %w", name, err)
+	}
+	return t, nil
+}
+
+// changed sends notifications about change to the users of the host.
+func (mailer *Mailer) changed(change *addressChange) {
+	if !mailer.changes {
+		return
+	}
+	for user, email := range mailer.recipients(change.Host) {
+		mailer.send(mailer.changedTemplate, email, &changedMail{change, user, mailer.fqdn(change.Host)})
+	}
+}
+
+// failed sends notifications about failure to the users of the host, when
+// the update failed the configured number of times in a row.
+func (mailer *Mailer) failed(failure *addressFailure) {
+	if mailer.failures <= 0 || failure.Failures != mailer.failures {
+		return
+	}
+	for user, email := range mailer.recipients(failure.Host) {
+		mailer.send(mailer.failedTemplate, email, &failedMail{failure, user, mailer.fqdn(failure.Host)})
+	}
+}
+
+func (mailer *Mailer) fqdn(host string) string {
+	return host + "." + mailer.zone
+}
+
+// recipients returns the email addresses of the users of host.
+func (mailer *Mailer) recipients(host string) map[string]string {
+	dblock.RLock()
+	defer dblock.RUnlock()
+	recipients := make(map[string]string)
+	entry, _ := hosts.Users(host)
+	for _, user := range entry {
+		if email := users.Email(user); email != "" {
+			recipients[user] = email
+		}
+	}
+	return recipients
+}
+
+// send renders the template t with data and queues the result for to.
+func (mailer *Mailer) send(t *template.Template, to string, data interface{}) {
+	var body bytes.Buffer
+	if err := t.Execute(&body, data); err != nil {
+		log.Println("Mail template failed", t.Name(), err)
+		return
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", mailer.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	// The template provides the remaining headers and the body.
+	buf.WriteString(strings.Replace(strings.Replace(body.String(), "\r\n", "\n", -1), "\n", "\r\n", -1))
+
+	select {
+	case mailer.queue <- &mailMessage{to, buf.Bytes()}:
+	default:
+		log.Println("Mail queue full, dropping mail to", to)
+	}
+}
+
+func (mailer *Mailer) run() {
+	for message := range mailer.queue {
+		if err := mailer.deliver(message); err != nil {
+			log.Println("Mail failed", message.to, err)
+		} else {
+			log.Println("Mail sent", message.to)
+		}
+	}
+}
+
+// deliver sends message with SMTP.
+func (mailer *Mailer) deliver(message *mailMessage) error {
+	addr := net.JoinHostPort(mailer.config.Host, strconv.Itoa(mailer.config.Port))
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	c, err := smtp.NewClient(conn, mailer.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if mailer.config.StartTLS {
+		if err = c.StartTLS(&tls.Config{ServerName: mailer.config.Host}); err != nil {
+			return err
+		}
+	}
+	if mailer.config.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", mailer.config.Username, mailer.config.Password, mailer.config.Host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(mailer.from.Address); err != nil {
+		return err
+	}
+	if err = c.Rcpt(message.to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(message.data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
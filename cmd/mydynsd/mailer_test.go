@@ -0,0 +1,192 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStub is a minimal SMTP server which records received messages.
+type smtpStub struct {
+	listener net.Listener
+	messages chan string
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &smtpStub{listener, make(chan string, 10)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+	return stub
+}
+
+func (stub *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch command := strings.ToUpper(strings.Fields(line + " x")[0]); command {
+		case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			stub.messages <- data.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+func (stub *smtpStub) port() int {
+	return stub.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (stub *smtpStub) receive(t *testing.T) string {
+	select {
+	case message := <-stub.messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return ""
+}
+
+func newTestMailer(t *testing.T, stub *smtpStub) *Mailer {
+	testDatabaseFiles(t, "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=:alice@example.com\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", "home:alice,bob\n", "")
+	mailer, err := NewMailer(&SMTPConfig{
+		Host: "127.0.0.1",
+		Port: stub.port(),
+		From: "mydyns <mydyns@example.com>",
+	}, "dyn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mailer
+}
+
+func TestMailerChanged(t *testing.T) {
+	stub := newSMTPStub(t)
+	mailer := newTestMailer(t, stub)
+	mailer.changed(&addressChange{
+		Host:   "home",
+		Family: "ipv4",
+		Old:    net.ParseIP("203.0.113.1"),
+		New:    net.ParseIP("203.0.113.2"),
+		User:   "alice",
+		Time:   time.Now(),
+	})
+	// Only alice has an email address.
+	if len(mailer.queue) != 1 {
+		t.Fatalf("expected one queued mail, got %d", len(mailer.queue))
+	}
+	if err := mailer.deliver(<-mailer.queue); err != nil {
+		t.Fatal(err)
+	}
+
+	message := stub.receive(t)
+	for _, expected := range []string{
+		"From: \"mydyns\" <mydyns@example.com>\r\n",
+		"To: alice@example.com\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"Subject: home changed to 203.0.113.2\r\n",
+		"Hello alice,\r\n",
+		"the ipv4 address of home.dyn.example.com changed from 203.0.113.1 to 203.0.113.2\r\n",
+	} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("message does not contain %q:\n%s", expected, message)
+		}
+	}
+}
+
+func TestMailerFailed(t *testing.T) {
+	stub := newSMTPStub(t)
+	mailer := newTestMailer(t, stub)
+
+	// Only the failures-th consecutive failure sends a mail.
+	for count := 1; count <= 5; count++ {
+		mailer.failed(&addressFailure{
+			Host:     "home",
+			Family:   "ipv6",
+			New:      net.ParseIP("2001:db8::1"),
+			Time:     time.Now(),
+			Error:    "nsupdate failed",
+			Failures: count,
+		})
+		expected := 0
+		if count >= mailer.failures {
+			expected = 1
+		}
+		if len(mailer.queue) != expected {
+			t.Fatalf("failure %d: expected %d queued mails, got %d", count, expected, len(mailer.queue))
+		}
+	}
+	if err := mailer.deliver(<-mailer.queue); err != nil {
+		t.Fatal(err)
+	}
+
+	message := stub.receive(t)
+	for _, expected := range []string{
+		"To: alice@example.com\r\n",
+		"Subject: Updates of home are failing\r\n",
+		"updating the ipv6 address of home.dyn.example.com to 2001:db8::1 failed 3 times,\r\n",
+		"nsupdate failed\r\n",
+	} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("message does not contain %q:\n%s", expected, message)
+		}
+	}
+}
@@ -20,12 +20,15 @@ with this program; if not, write to the Free Software Foundation, Inc.,
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/longsleep/mydyns"
 	"gopkg.in/alecthomas/kingpin.v1"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -43,19 +46,20 @@ var (
 )
 
 var update *NsUpdate
-var secret *SecretFile
+var dnszone string
+var allowPrivate bool
+var records *RecordStore
+var audit *AuditLog
+var webhooks Webhooks
+var mailer *Mailer
+var limits *Limits
+var secret *mydyns.SecretFile
 
 var dblock sync.RWMutex
-var users *HtpasswdFile
-var hosts *HostsFile
-var security *SecurityFile
-
-// TokenData defines the data to encode into tokens.
-type TokenData struct {
-	Host     string
-	User     string
-	Security []byte
-}
+var users *mydyns.HtpasswdFile
+var hosts *mydyns.HostsFile
+var security *mydyns.SecurityFile
+var admins *mydyns.HtpasswdFile
 
 // isPrivateNetwork checks if an IP address is inside a private network.
 func isPrivateNetwork(ip net.IP) bool {
@@ -71,27 +75,88 @@ func isPrivateNetwork(ip net.IP) bool {
 // main is our blocking runner.
 func main() {
 
+	// Read configuration file first, it provides the defaults for flags.
+	config, err := NewConfig(configFileFromArgs(os.Args[1:]))
+	if err != nil {
+		kingpin.Fatalf("error reading config: %s", err)
+	}
+
 	// Parse command line.
 	var (
-		listen       = kingpin.Flag("listen", "Listen address.").PlaceHolder("IP:PORT").Default("127.0.0.1:8080").String()
-		nsupdate     = kingpin.Flag("nsupdate", "Path to nsupdate binary.").Default("/usr/bin/nsupdate").ExistingFile()
-		server       = kingpin.Flag("server", "DNS server hostname.").Required().String()
-		keyfile      = kingpin.Flag("key", "DNS shared secrets file.").Required().PlaceHolder("KEYFILE").ExistingFile()
-		zone         = kingpin.Flag("zone", "Zone where updates should be made.").Required().String()
-		ttl          = kingpin.Flag("ttl", "Ttl for DNS entries.").Default("300").Int()
-		usersfile    = kingpin.Flag("users", "Htpasswd users database.").Required().PlaceHolder("USERSFILE").ExistingFile()
-		hostsfile    = kingpin.Flag("hosts", "Hosts database.").Required().PlaceHolder("HOSTSFILE").ExistingFile()
-		secretfile   = kingpin.Flag("secret", "Auth token secret file.").Required().ExistingFile()
-		securityfile = kingpin.Flag("security", "Security secret database.").Required().ExistingFile()
-		logfile      = kingpin.Flag("log", "Log file.").String()
+		_            = kingpin.Flag("config", "Configuration file.").OverrideDefaultFromEnvar(envName("config")).PlaceHolder("CONFIGFILE").String()
+		validate     = kingpin.Flag("validate", "Validate configuration and referenced files, then exit.").Bool()
+		listen       = config.Flag("listen", "Listen address.", "127.0.0.1:8080").PlaceHolder("IP:PORT").String()
+		backendname  = config.Flag("backend", "Backend to publish records with, nsupdate, dns, zonefile, powerdns or hostsfile.", backendNsUpdate).Enum(backendNsUpdate, backendDNS, backendZoneFile, backendPowerDNS, backendHostsFile)
+		nsupdate     = config.Flag("nsupdate", "Path to nsupdate binary.", "/usr/bin/nsupdate").String()
+		server       = config.Flag("server", "DNS server hostname, required for the nsupdate backend.", "").String()
+		keyfile      = config.Flag("key", "DNS shared secrets file, required for the nsupdate backend.", "").PlaceHolder("KEYFILE").ExistingFile()
+		zone         = config.RequiredFlag("zone", "Zone where updates should be made.").String()
+		ttl          = config.Flag("ttl", "Ttl for DNS entries.", "300").Int()
+		private      = config.Flag("allow-private", "Allow private addresses for hosts, for zones which are only used internally.", "").Bool()
+		usersfile    = config.RequiredFlag("users", "Htpasswd users database.").PlaceHolder("USERSFILE").ExistingFile()
+		hostsfile    = config.RequiredFlag("hosts", "Hosts database.").PlaceHolder("HOSTSFILE").ExistingFile()
+		secretfile   = config.RequiredFlag("secret", "Auth token secret file.").ExistingFile()
+		securityfile = config.RequiredFlag("security", "Security secret database.").ExistingFile()
+		adminsfile   = config.Flag("admins", "Htpasswd database of admin API users. The admin API is disabled when not set.", "").PlaceHolder("ADMINSFILE").ExistingFile()
+		logfile      = config.Flag("log", "Log file.", "").String()
+		watch        = config.Flag("watch", "Reload databases automatically when their files change.", "").Bool()
+		watchdelay   = config.Flag("watch-delay", "Delay reload until files did not change for this duration.", "2s").Duration()
+		watchpoll    = config.Flag("watch-poll", "Polling interval when file notifications are not available.", "10s").Duration()
+		shutdown     = config.Flag("shutdown-timeout", "Time to finish requests and pending updates on shutdown.", "10s").Duration()
+		statefile    = config.Flag("state", "File to keep the status of records across restarts.", "").PlaceHolder("STATEFILE").String()
+		auditfile    = config.Flag("audit", "Audit log file. Auditing is disabled when not set.", "").PlaceHolder("AUDITFILE").String()
+		retention    = config.Flag("audit-retention", "Remove audit events older than this duration, 0 keeps all events.", "2160h").Duration()
+		limitip      = config.Flag("limit-ip", "Rate limit of requests per client address, like 30/1m. Disabled when empty.", "").PlaceHolder("N/DURATION").String()
+		limituser    = config.Flag("limit-user", "Rate limit of token and update requests per user. Disabled when empty.", "").PlaceHolder("N/DURATION").String()
+		limithost    = config.Flag("limit-host", "Rate limit of updates per host. Disabled when empty.", "").PlaceHolder("N/DURATION").String()
+		lockfailures = config.Flag("lockout-failures", "Lock out users after this many failed authentications, 0 disables lockouts.", "5").Int()
+		lockout      = config.Flag("lockout", "Duration of lockouts.", "15m").Duration()
+		limitsfile   = config.Flag("limits-state", "File to keep rate limits and lockouts across restarts.", "").PlaceHolder("LIMITSFILE").String()
 	)
 
-	kingpin.CommandLine.Help = "Manage your own dynamic DNS zone."
+	var webhookconfigs []*WebhookConfig
+	if err := config.Section("webhooks", &webhookconfigs); err != nil {
+		kingpin.Fatalf("invalid config: %s", err)
+	}
+	var registrationconfig *RegistrationConfig
+	if err := config.Section("registration", &registrationconfig); err != nil {
+		kingpin.Fatalf("invalid config: %s", err)
+	}
+	var smtpconfig *SMTPConfig
+	if err := config.Section("smtp", &smtpconfig); err != nil {
+		kingpin.Fatalf("invalid config: %s", err)
+	}
+	var reverseconfigs []*ReverseZoneConfig
+	if err := config.Section("reverse", &reverseconfigs); err != nil {
+		kingpin.Fatalf("invalid config: %s", err)
+	}
+	var dnsconfig *DNSServerConfig
+	if err := config.Section("dns", &dnsconfig); err != nil {
+		kingpin.Fatalf("invalid config: %s", err)
+	}
+	var zonefileconfig *ZoneFileConfig
+	if err := config.Section("zonefile", &zonefileconfig); err != nil {
+		kingpin.Fatalf("invalid config: %s", err)
+	}
+	var powerdnsconfig *PowerDNSConfig
+	if err := config.Section("powerdns", &powerdnsconfig); err != nil {
+		kingpin.Fatalf("invalid config: %s", err)
+	}
+	var hostsfileconfig *HostsFileConfig
+	if err := config.Section("hostsfile", &hostsfileconfig); err != nil {
+		kingpin.Fatalf("invalid config: %s", err)
+	}
+
+	kingpin.CommandLine.Help = "Manage your own dynamic DNS zone. All flags can also be set in the configuration file or as MYDYNS_* environment variables."
 	kingpin.Version(version)
 	kingpin.Parse()
 
+	if err := config.Check(); err != nil {
+		kingpin.Fatalf("invalid config: %s", err)
+	}
+
 	// First things first, open up log.
-	if *logfile != "" {
+	if *logfile != "" && !*validate {
 		if f, err := os.OpenFile(*logfile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0660); err == nil {
 			defer f.Close()
 			log.SetOutput(f)
@@ -100,42 +165,171 @@ func main() {
 		}
 	}
 
-	log.Printf("Starting up on: %s\n", *listen)
-
 	// Initialize.
-	update = NewNsUpdate(*nsupdate, *server, *keyfile, *zone, *ttl)
-	secret, _ = NewSecretFile(*secretfile)
+	dnszone = strings.ToLower(strings.TrimSuffix(*zone, "."))
+	allowPrivate = *private
+	if r, err := NewRecordStore(*statefile); err == nil {
+		records = r
+	} else {
+		log.Fatalf("error loading state file: %v", err)
+	}
+	audit = NewAuditLog(*auditfile, *retention)
+	if l, err := NewLimits(&LimitsConfig{
+		IP:       *limitip,
+		User:     *limituser,
+		Host:     *limithost,
+		Failures: *lockfailures,
+		Lockout:  *lockout,
+		File:     *limitsfile,
+	}); err == nil {
+		limits = l
+	} else {
+		log.Fatalf("error in limits: %v", err)
+	}
+	if hooks, err := NewWebhooks(webhookconfigs); err == nil {
+		webhooks = hooks
+	} else {
+		log.Fatalf("error in webhooks: %v", err)
+	}
+	if smtpconfig != nil {
+		if m, err := NewMailer(smtpconfig, dnszone); err == nil {
+			mailer = m
+		} else {
+			log.Fatalf("error in smtp: %v", err)
+		}
+	}
+	if s, err := mydyns.NewSecretFile(*secretfile); err == nil {
+		secret = s
+	} else {
+		log.Fatalf("error loading secret file: %v", err)
+	}
 
 	// Load databases.
-	dbLoader := func() {
-		dblock.Lock()
-		defer dblock.Unlock()
-		users, _ = NewHtpasswdFile(*usersfile)
-		hosts, _ = NewHostsFile(*hostsfile)
-		security, _ = NewSecurityFile(*securityfile)
+	dbfiles := &DatabaseFiles{
+		Users:    *usersfile,
+		Hosts:    *hostsfile,
+		Security: *securityfile,
+		Admins:   *adminsfile,
+	}
+	if err := loadDatabases(dbfiles); err != nil {
+		log.Fatalf("error loading databases: %v", err)
 	}
-	dbLoader()
+
+	// Create backend, the records of the hosts are published with it.
+	var backend Backend
+	var dnsserver *DNSServer
+	if *backendname != backendNsUpdate && len(reverseconfigs) > 0 {
+		log.Fatalf("reverse zones require the nsupdate backend")
+	}
+	switch *backendname {
+	case backendNsUpdate:
+		reverse, err := NewReverseZones(reverseconfigs, *server, *keyfile)
+		if err != nil {
+			log.Fatalf("error in reverse zones: %v", err)
+		}
+		if backend, err = NewNsUpdateBackend(*nsupdate, *server, *keyfile, dnszone, *ttl, reverse, records); err != nil {
+			log.Fatalf("error in nsupdate backend: %v", err)
+		}
+	case backendDNS:
+		if dnsserver, err = NewDNSServer(dnsconfig, dnszone, *ttl, records); err != nil {
+			log.Fatalf("error in dns server: %v", err)
+		}
+		backend = dnsserver
+	case backendZoneFile:
+		if backend, err = NewZoneFile(zonefileconfig, dnszone, *ttl, records); err != nil {
+			log.Fatalf("error in zone file: %v", err)
+		}
+	case backendPowerDNS:
+		if backend, err = NewPowerDNS(powerdnsconfig, dnszone, *ttl); err != nil {
+			log.Fatalf("error in powerdns backend: %v", err)
+		}
+	case backendHostsFile:
+		if backend, err = NewHostsFileBackend(hostsfileconfig, dnszone, records); err != nil {
+			log.Fatalf("error in hosts file backend: %v", err)
+		}
+	}
+	update = NewNsUpdate(backend, records, audit)
+
+	var registration *Registration
+	if registrationconfig != nil {
+		if registration, err = NewRegistration(registrationconfig, dbfiles); err != nil {
+			log.Fatalf("error in registration: %v", err)
+		}
+	}
+
+	// Stop here, when only validating.
+	if *validate {
+		if *backendname == backendNsUpdate {
+			if _, err := ioutil.ReadFile(*keyfile); err != nil {
+				log.Fatalf("error reading key file: %v", err)
+			}
+		}
+		fmt.Println("Configuration is valid")
+		return
+	}
+
+	log.Printf("Starting up on: %s\n", *listen)
 
 	// Create URL routing.
 	mux := http.NewServeMux()
 	mux.HandleFunc("/update", updateHandler)
 	mux.HandleFunc("/token", tokenHandler)
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/health", healthHandler)
+	if registration != nil {
+		mux.Handle("/register", registration)
+	}
+	mux.Handle(apiPrefix, NewAPI(registration))
+	if dbfiles.Admins != "" {
+		mux.Handle("/admin/", NewAdminAPI(dbfiles))
+	}
 
 	// Start our worker.
 	go update.run()
+	if dnsserver != nil {
+		if err := dnsserver.start(); err != nil {
+			log.Fatalf("error starting dns server: %v", err)
+		}
+	}
+	if *auditfile != "" {
+		go audit.run()
+	}
+	webhooks.run()
+	go limits.run()
+	if mailer != nil {
+		go mailer.run()
+	}
 
 	// Create reload listener.
+	reload := func() {
+		log.Println("Reloading databases ...")
+		if err := loadDatabases(dbfiles); err != nil {
+			log.Println("Reload failed, keeping previous databases:", err)
+		}
+	}
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGHUP)
 	go func() {
 		for {
 			// Block for signal.
 			<-sigc
-			log.Println("Reloading databases ...")
-			dbLoader()
+			reload()
 		}
 	}()
 
+	// Watch database files.
+	if *watch {
+		files := []string{dbfiles.Users, dbfiles.Hosts, dbfiles.Security}
+		if dbfiles.Admins != "" {
+			files = append(files, dbfiles.Admins)
+		}
+		watcher, err := NewFileWatcher(files, *watchdelay, *watchpoll, reload)
+		if err != nil {
+			log.Fatalf("error watching databases: %v", err)
+		}
+		go watcher.run()
+	}
+
 	// Start HTTP service.
 	s := &http.Server{
 		Addr:           *listen,
@@ -144,7 +338,39 @@ func main() {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	log.Fatal(s.ListenAndServe())
+
+	// Create shutdown listener.
+	stopped := make(chan bool)
+	stopc := make(chan os.Signal, 1)
+	signal.Notify(stopc, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-stopc
+		log.Printf("Received %s, shutting down ...\n", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdown)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Println("HTTP shutdown failed", err)
+		}
+		if err := update.stop(ctx); err != nil {
+			log.Println("Flushing pending updates failed", err)
+		}
+		if err := audit.stop(ctx); err != nil {
+			log.Println("Flushing audit log failed", err)
+		}
+		if dnsserver != nil {
+			dnsserver.shutdown(ctx)
+		}
+		if err := limits.save(); err != nil {
+			log.Println("Failed to save limits", err)
+		}
+		close(stopped)
+	}()
+
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Println("Shutdown complete")
 
 }
 
@@ -156,81 +382,31 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 	myip := r.Form.Get("myip")
 	address := r.Form.Get("address")
 
-	// Validate token.
-	if token == "" {
-		http.Error(w, "token parameter required", http.StatusBadRequest)
-		return
-	}
-	var data TokenData
-	if err := secret.Decode("u", token, &data); err != nil {
-		http.Error(w, fmt.Sprintf("invalid token: %s", err), http.StatusForbidden)
-		return
-	}
-
-	// Read lock so we hold, when we are currently reloading things.
-	dblock.RLock()
-
-	// Validate security entry.
-	if !security.Check(data.Security, data.User) {
-		http.Error(w, "invalid security code", http.StatusForbidden)
-		dblock.RUnlock()
-		return
-	}
-
-	// Validate hostname access in users database.
-	if !hosts.CheckUser(data.Host, data.User) {
-		http.Error(w, "access denied", http.StatusForbidden)
-		dblock.RUnlock()
-		return
-	}
-
-	// Unlock after checks done.
-	defer dblock.RUnlock()
-
 	// Join parameters.
 	if address != "" {
 		// For compatibility reasons we also support the address parameter.
 		myip = address
 	}
 
-	// Get IP.
-	var ip net.IP
-	if myip == "" || myip == "auto" {
-		myip = strings.SplitN(r.RemoteAddr, ":", 2)[0]
-		ip = net.ParseIP(myip)
-		if ip.IsLoopback() || isPrivateNetwork(ip) {
-			// Running through a proxy?
-			myip = r.Header.Get("X-Real-IP")
-			if myip != "" {
-				ip = net.ParseIP(myip)
-			}
-		}
-	} else {
-		ip = net.ParseIP(myip)
-	}
-	// Validate IP.
-	if ip == nil || !ip.IsGlobalUnicast() {
-		http.Error(w, "invalid ip", http.StatusBadRequest)
-		return
-	} else if isPrivateNetwork(ip) {
-		http.Error(w, "private ip not allowed", http.StatusBadRequest)
+	_, check := r.Form["check"]
+	result, err := updateHosts(r, token, myip, check)
+	if err != nil {
+		legacyError(w, err)
 		return
 	}
 
-	if _, ok := r.Form["check"]; ok {
-		fmt.Fprintf(w, fmt.Sprintf("%s\n", ip))
+	if check {
+		fmt.Fprintf(w, fmt.Sprintf("%s\n", result.IP))
 		return
 	}
-
-	// Queue changes.
-	if err := update.update(&nsUpdateData{data.Host, &ip}); err != nil {
-		log.Println("Update failed", err)
-		http.Error(w, fmt.Sprintf("update failed: %s", err), http.StatusTeapot)
-	} else {
-		log.Println("Queued update", data.Host, ip)
+	if len(result.Hosts) == 1 {
+		fmt.Fprintf(w, "accepted\n")
+		return
+	}
+	// Report the result of each host of the token.
+	for _, host := range result.Hosts {
+		fmt.Fprintf(w, "%s: %s\n", mydyns.UnicodeHostname(host.Name), strings.Replace(host.Status, "_", " ", -1))
 	}
-
-	fmt.Fprintf(w, "accepted\n")
 
 }
 
@@ -239,64 +415,72 @@ func tokenHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Basic auth is required.
 	username, password, ok := getBasicAuth(r)
-	if ok {
-		// Read lock so we hold, when we are currently reloading things.
-		dblock.RLock()
-		if !users.CheckPassword(username, password) {
-			http.Error(w, "authentication failed", http.StatusForbidden)
-			dblock.RUnlock()
-			return
-		}
-	} else {
+	if !ok {
 		http.Error(w, "basic auth required", http.StatusForbidden)
 		return
 	}
 
 	r.ParseForm()
-	hostname := r.Form.Get("hostname")
-	if hostname == "" {
-		http.Error(w, "hostname parameter required", http.StatusBadRequest)
+	token, _, err := createToken(r, username, password, r.Form.Get("hostname"))
+	if err != nil {
+		legacyError(w, err)
 		return
 	}
+	fmt.Fprintln(w, token)
 
-	// Validate hostname.
-	if url, err := url.Parse(fmt.Sprintf("http://%s/", hostname)); err != nil {
-		http.Error(w, fmt.Sprintf("invalid hostname: %s", err), http.StatusBadRequest)
-		return
-	} else {
-		host := strings.SplitN(url.Host, ":", 2)[0]
-		host = strings.SplitN(host, ".", 2)[0]
-		if host != hostname {
-			http.Error(w, "invalid hostname", http.StatusBadRequest)
-			return
-		}
-	}
+}
 
-	// Block when we are reloading things.
-	dblock.RLock()
+// statusHandler reports the records of the hosts of a token or of the user
+// authenticated with basic auth, one line per record.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
 
-	// Validate hostname access in users database.
-	if !hosts.CheckUser(hostname, username) {
-		http.Error(w, "access denied", http.StatusForbidden)
-		dblock.RUnlock()
+	r.ParseForm()
+	username, password, basic := getBasicAuth(r)
+	result, err := hostsStatus(r, r.Form.Get("token"), username, password, basic)
+	if err != nil {
+		legacyError(w, err)
 		return
 	}
 
-	// Releas lock.
-	dblock.RUnlock()
-
-	// Prepare and encode token.
-	data := &TokenData{
-		Host:     hostname,
-		User:     username,
-		Security: security.Secret(username),
-	}
-	if token, err := secret.Encode("u", data); err == nil {
-		log.Println("Token created by", username, hostname)
-		fmt.Fprintln(w, token)
-	} else {
-		log.Println("Error while creating token", err)
-		http.Error(w, fmt.Sprintf("failed to create token: %s", err), http.StatusInternalServerError)
+	for _, host := range result {
+		if len(host.Records) == 0 {
+			fmt.Fprintf(w, "%s unknown\n", mydyns.UnicodeHostname(host.Name))
+		}
+		for _, t := range []string{"A", "AAAA"} {
+			record, ok := host.Records[t]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(w, "%s %s", mydyns.UnicodeHostname(host.Name), t)
+			if record.Address != nil {
+				fmt.Fprintf(w, " %s updated %s from %s", record.Address, record.Updated.Format(time.RFC3339), record.Source)
+			}
+			if record.Pending != nil {
+				fmt.Fprintf(w, " pending %s", record.Pending)
+			}
+			if record.Error != "" {
+				fmt.Fprintf(w, " failed %s: %s", record.Failed.Format(time.RFC3339), record.Error)
+			}
+			fmt.Fprintf(w, "\n")
+		}
 	}
 
 }
+
+// legacyError replies to requests of the legacy endpoints with the plain text
+// message of err.
+func legacyError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var se *serviceError
+	if errors.As(err, &se) {
+		status = se.status
+		if retry := retryAfter(se.retry); retry != "" {
+			w.Header().Set("Retry-After", retry)
+		}
+		if se.code == "update_failed" {
+			// The legacy endpoint always used this status for failed updates.
+			status = http.StatusTeapot
+		}
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,69 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// addressChange describes an applied change of the address of a host.
+type addressChange struct {
+	Host   string    `json:"host"`
+	Family string    `json:"family"`
+	Old    net.IP    `json:"old,omitempty"`
+	New    net.IP    `json:"new"`
+	User   string    `json:"user,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// addressFailure describes a failed update of the address of a host.
+type addressFailure struct {
+	Host     string
+	Family   string
+	New      net.IP
+	User     string
+	Time     time.Time
+	Error    string
+	Failures int
+}
+
+// addressFamily returns the name of the address family of ip.
+func addressFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// notifyChanged notifies webhooks and users about change.
+func notifyChanged(change *addressChange) {
+	webhooks.changed(change)
+	if mailer != nil {
+		mailer.changed(change)
+	}
+}
+
+// notifyFailed notifies users about failure.
+func notifyFailed(failure *addressFailure) {
+	if mailer != nil {
+		mailer.failed(failure)
+	}
+}
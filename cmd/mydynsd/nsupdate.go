@@ -20,8 +20,8 @@ with this program; if not, write to the Free Software Foundation, Inc.,
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -29,128 +29,440 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"time"
+
+	"github.com/longsleep/mydyns"
 )
 
 type nsUpdateData struct {
 	hostname string
 	ip       *net.IP
+	source   string
+	user     string
+	wildcard bool
 }
 
+// NsUpdate is the worker which collects queued updates into batches and
+// publishes them with its backend.
 type NsUpdate struct {
-	exe     string
-	server  string
-	keyfile string
-	zone    string
-	ttl     int
-	queue   chan *nsUpdateData
-	exit    chan bool
+	backend Backend
+	records *RecordStore
+	audit   *AuditLog
+	queue   chan []*nsUpdateData
+	exit    chan context.Context
+	done    chan bool
 	timer   chan bool
 }
 
-func NewNsUpdate(exe, server, keyfile, zone string, ttl int) *NsUpdate {
+func NewNsUpdate(backend Backend, records *RecordStore, audit *AuditLog) *NsUpdate {
 	return &NsUpdate{
-		exe:     exe,
-		server:  server,
-		keyfile: keyfile,
-		zone:    zone,
-		ttl:     ttl,
-		queue:   make(chan *nsUpdateData, 100),
-		exit:    make(chan bool),
+		backend: backend,
+		records: records,
+		audit:   audit,
+		queue:   make(chan []*nsUpdateData, 100),
+		exit:    make(chan context.Context),
+		done:    make(chan bool),
 	}
 }
 
 func (update *NsUpdate) run() {
-	work := make(map[string]*net.IP)
+	work := make(map[string]*nsUpdateData)
 	var err error
 	c := time.Tick(5 * time.Second)
 	for {
 		select {
 		case <-c:
-		Work:
-			for {
-				select {
-				case data := <-update.queue:
-					var t string
-					if data.ip.To4() != nil {
-						t = "v4"
-					} else {
-						t = "v6"
-					}
-					log.Println("Processing update", data.hostname, data.ip, t)
-					work[data.hostname+" "+t] = data.ip
-				default:
-					// No data available. Non blocking.
-					break Work
-				}
-			}
+			update.collect(work)
 			if len(work) > 0 {
 				// Do some work.
-				err = update.process(work)
+				err = update.backend.process(context.Background(), work)
 				if err != nil {
 					// Error.
 					log.Println("Update failed", err)
+					update.failed(work, err)
+				} else {
+					update.applied(work)
+					work = make(map[string]*nsUpdateData)
+				}
+			}
+		case ctx := <-update.exit:
+			// Flush everything which is pending in one final batch.
+			update.collect(work)
+			if len(work) > 0 {
+				log.Printf("Flushing %d pending updates\n", len(work))
+				err = update.backend.process(ctx, work)
+				if err != nil {
+					log.Println("Update failed, pending updates are lost", err)
+					update.failed(work, err)
 				} else {
-					work = make(map[string]*net.IP)
+					update.applied(work)
 				}
 			}
-		case <-update.exit:
+			close(update.done)
 			return
 		}
 	}
 }
 
-func (update *NsUpdate) process(work map[string]*net.IP) error {
+// collect moves all queued updates into work without blocking.
+func (update *NsUpdate) collect(work map[string]*nsUpdateData) {
+	for {
+		select {
+		case batch := <-update.queue:
+			for _, data := range batch {
+				var t string
+				if data.ip.To4() != nil {
+					t = "v4"
+				} else {
+					t = "v6"
+				}
+				log.Println("Processing update", mydyns.UnicodeHostname(data.hostname), data.ip, t)
+				work[data.hostname+" "+t] = data
+			}
+		default:
+			// No data available. Non blocking.
+			return
+		}
+	}
+}
 
-	f, err := ioutil.TempFile(os.TempDir(), "mydyns")
-	if err != nil {
+// applied records the successfully processed work and notifies about
+// changed addresses.
+func (update *NsUpdate) applied(work map[string]*nsUpdateData) {
+	now := time.Now()
+	events := make([]*auditEvent, 0, len(work))
+	var changes []*addressChange
+	for _, data := range work {
+		event := &auditEvent{
+			Action: auditUpdate,
+			User:   data.user,
+			Host:   data.hostname,
+			Client: data.source,
+			New:    data.ip.String(),
+		}
+		old := update.records.address(data.hostname, *data.ip)
+		if old != nil {
+			event.Old = old.String()
+		}
+		events = append(events, event)
+		if !old.Equal(*data.ip) {
+			change := &addressChange{
+				Host:   data.hostname,
+				Family: addressFamily(*data.ip),
+				Old:    old,
+				New:    *data.ip,
+				User:   data.user,
+				Time:   now,
+			}
+			changes = append(changes, change)
+		}
+	}
+	update.records.applied(work)
+	for _, event := range events {
+		update.audit.record(event)
+	}
+	for _, change := range changes {
+		notifyChanged(change)
+	}
+}
+
+// failed records the failure of work. Repeated failures of the same record
+// are only audited once.
+func (update *NsUpdate) failed(work map[string]*nsUpdateData, err error) {
+	for _, failure := range update.records.failed(work, err) {
+		data := failure.data
+		if failure.failures == 1 {
+			update.audit.record(&auditEvent{
+				Action: auditUpdateFailed,
+				User:   data.user,
+				Host:   data.hostname,
+				Client: data.source,
+				New:    data.ip.String(),
+				Detail: err.Error(),
+			})
+		}
+		notifyFailed(&addressFailure{
+			Host:     data.hostname,
+			Family:   addressFamily(*data.ip),
+			New:      *data.ip,
+			User:     data.user,
+			Time:     time.Now(),
+			Error:    err.Error(),
+			Failures: failure.failures,
+		})
+	}
+}
+
+// stop makes the worker process all pending updates and waits until it has
+// exited or ctx is done.
+func (update *NsUpdate) stop(ctx context.Context) error {
+	select {
+	case update.exit <- ctx:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-update.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// update queues data, all given data is processed in the same batch.
+func (update *NsUpdate) update(data ...*nsUpdateData) error {
+	// Hold the records until they are marked, so the worker cannot apply
+	// them before.
+	update.records.Lock()
+	defer update.records.Unlock()
+
+	// Send non blocking.
+	select {
+	case update.queue <- data:
+		update.records.queued(data)
+		return nil
+	default:
+		return errors.New("update queue full")
+	}
+}
+
+// NsUpdateBackend sends the updates with nsupdate as Dynamic DNS Update
+// requests to the DNS server, and maintains PTR records in reverse zones.
+type NsUpdateBackend struct {
+	exe     string
+	server  string
+	keyfile string
+	zone    string
+	ttl     int
+	reverse ReverseZones
+	records *RecordStore
+	// pending holds PTR changes which failed, they are sent again with the
+	// next batch.
+	pending map[*ReverseZone]ptrChanges
+}
+
+func NewNsUpdateBackend(exe, server, keyfile, zone string, ttl int, reverse ReverseZones, records *RecordStore) (*NsUpdateBackend, error) {
+	if server == "" || keyfile == "" {
+		return nil, errors.New("server and key are required")
+	}
+	if _, err := os.Stat(exe); err != nil {
+		return nil, err
+	}
+	return &NsUpdateBackend{
+		exe:     exe,
+		server:  server,
+		keyfile: keyfile,
+		zone:    zone,
+		ttl:     ttl,
+		reverse: reverse,
+		records: records,
+		pending: make(map[*ReverseZone]ptrChanges),
+	}, nil
+}
+
+func (update *NsUpdateBackend) process(ctx context.Context, work map[string]*nsUpdateData) error {
+
+	log.Printf("Processing %d updates\n", len(work))
+	script, reverse := update.scripts(work)
+	if err := update.send(ctx, update.keyfile, script); err != nil {
 		return err
 	}
-	log.Printf("Processing %d updates in %s", len(work), f.Name())
-	defer os.Remove(f.Name())
-	w := bufio.NewWriter(f)
 
-	w.WriteString(fmt.Sprintf("server %s\n", update.server))
-	w.WriteString(fmt.Sprintf("zone %s\n", update.zone))
+	// The forward zone is updated, failing PTR changes must not fail the
+	// batch. They are logged and sent again with the next batch.
+	for _, zone := range update.reverse {
+		changes := make(ptrChanges)
+		changes.merge(update.pending[zone])
+		changes.merge(reverse[zone])
+		if len(changes) == 0 {
+			continue
+		}
+		var script bytes.Buffer
+		script.WriteString(fmt.Sprintf("server %s\n", zone.server))
+		script.WriteString(fmt.Sprintf("zone %s\n", zone.zone))
+		changes.write(&script, update.ttl)
+		script.WriteString("send\n")
+		if err := update.send(ctx, zone.keyfile, script.Bytes()); err != nil {
+			log.Printf("Reverse zone %s update failed, retrying with next batch: %s\n", zone.zone, err)
+			if n := changes.expire(time.Now().Add(-ptrRetention)); n > 0 {
+				log.Printf("Dropping %d PTR changes of reverse zone %s older than %s\n", n, zone.zone, ptrRetention)
+			}
+			update.pending[zone] = changes
+			continue
+		}
+		delete(update.pending, zone)
+	}
+	return nil
+
+}
+
+// scripts returns the nsupdate script for the forward zone and the PTR
+// changes for each reverse zone.
+func (update *NsUpdateBackend) scripts(work map[string]*nsUpdateData) ([]byte, map[*ReverseZone]ptrChanges) {
+	var script bytes.Buffer
+	script.WriteString(fmt.Sprintf("server %s\n", update.server))
+	script.WriteString(fmt.Sprintf("zone %s\n", update.zone))
+
+	// PTR record changes for each reverse zone.
+	now := time.Now()
+	reverse := make(map[*ReverseZone]ptrChanges)
+	ptr := func(ip net.IP) ptrChanges {
+		zone := update.reverse.find(ip)
+		if zone == nil {
+			return nil
+		}
+		if reverse[zone] == nil {
+			reverse[zone] = make(ptrChanges)
+		}
+		return reverse[zone]
+	}
+
+	for _, data := range work {
+		if !mydyns.ValidHostname(data.hostname) {
+			// Never write anything but valid names into the script.
+			log.Println("Skipping update of invalid hostname", data.hostname)
+			continue
+		}
+		recordtype := recordType(*data.ip)
+		script.WriteString(fmt.Sprintf("update delete %s.%s. %s\n", data.hostname, update.zone, recordtype))
+		script.WriteString(fmt.Sprintf("update add %s.%s. %d %s %s\n", data.hostname, update.zone, update.ttl, recordtype, data.ip))
+		// Names below the host follow its address, or are removed when the
+		// wildcard option was turned off.
+		script.WriteString(fmt.Sprintf("update delete *.%s.%s. %s\n", data.hostname, update.zone, recordtype))
+		if data.wildcard {
+			script.WriteString(fmt.Sprintf("update add *.%s.%s. %d %s %s\n", data.hostname, update.zone, update.ttl, recordtype, data.ip))
+		}
+
+		target := fmt.Sprintf("%s.%s.", data.hostname, update.zone)
+		if old := update.records.address(data.hostname, *data.ip); old != nil && !old.Equal(*data.ip) {
+			// Only remove the PTR record of the old address if it still
+			// points to this host.
+			if changes := ptr(old); changes != nil {
+				changes.remove(reverseName(old), target, now)
+			}
+		}
+		if changes := ptr(*data.ip); changes != nil {
+			changes.set(reverseName(*data.ip), target, now)
+		}
+	}
+	script.WriteString("send\n")
+	return script.Bytes(), reverse
+}
+
+// ptrRetention is how long failed PTR changes are sent again, before they
+// are dropped.
+const ptrRetention = 24 * time.Hour
+
+// ptrChange is the change of the PTR record of a single address.
+type ptrChange struct {
+	// target is the host the address points to, empty if the records of
+	// removed hosts are only deleted.
+	target  string
+	removed []string
+	queued  time.Time
+}
+
+// ptrChanges holds the PTR changes of a reverse zone by the name of the
+// address. Only the latest change of each address is kept.
+type ptrChanges map[string]*ptrChange
+
+// set makes the PTR record of name point to target, replacing all earlier
+// changes of name.
+func (changes ptrChanges) set(name, target string, queued time.Time) {
+	changes[name] = &ptrChange{target: target, queued: queued}
+}
+
+// remove deletes the PTR record of name, if it points to target.
+func (changes ptrChanges) remove(name, target string, queued time.Time) {
+	change, ok := changes[name]
+	if !ok {
+		change = &ptrChange{}
+		changes[name] = change
+	}
+	if change.target == target {
+		change.target = ""
+	}
+	for _, removed := range change.removed {
+		if removed == target {
+			change.queued = queued
+			return
+		}
+	}
+	change.removed = append(change.removed, target)
+	change.queued = queued
+}
+
+// merge applies the later changes of other.
+func (changes ptrChanges) merge(other ptrChanges) {
+	for name, change := range other {
+		if change.target != "" {
+			changes[name] = change
+			continue
+		}
+		for _, target := range change.removed {
+			changes.remove(name, target, change.queued)
+		}
+	}
+}
 
-	var recordtype string
-	for hostname, ip := range work {
-		hostname = strings.SplitN(hostname, " ", 2)[0]
-		if ip.To4() != nil {
-			recordtype = "A"
-		} else {
-			recordtype = "AAAA"
+// expire drops the changes queued before and returns how many were dropped.
+func (changes ptrChanges) expire(before time.Time) int {
+	n := 0
+	for name, change := range changes {
+		if change.queued.Before(before) {
+			delete(changes, name)
+			n++
 		}
-		w.WriteString(fmt.Sprintf("update delete %s.%s. %s\n", hostname, update.zone, recordtype))
-		w.WriteString(fmt.Sprintf("update add %s.%s. %d %s %s\n", hostname, update.zone, update.ttl, recordtype, ip))
 	}
+	return n
+}
+
+// write writes the nsupdate commands of all changes sorted by name.
+func (changes ptrChanges) write(script *bytes.Buffer, ttl int) {
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		change := changes[name]
+		for _, target := range change.removed {
+			script.WriteString(fmt.Sprintf("update delete %s. PTR %s\n", name, target))
+		}
+		if change.target != "" {
+			script.WriteString(fmt.Sprintf("update delete %s. PTR\n", name))
+			script.WriteString(fmt.Sprintf("update add %s. %d PTR %s\n", name, ttl, change.target))
+		}
+	}
+}
 
-	w.WriteString("send\n")
+// send runs nsupdate with keyfile for script.
+func (update *NsUpdateBackend) send(ctx context.Context, keyfile string, script []byte) error {
 
-	w.Flush()
+	f, err := ioutil.TempFile(os.TempDir(), "mydyns")
+	if err != nil {
+		return err
+	}
+	log.Println("Processing updates in", f.Name())
+	defer os.Remove(f.Name())
+	_, err = f.Write(script)
 	f.Close()
+	if err != nil {
+		return err
+	}
 
 	// Run command.
-	cmd := exec.Command(update.exe, "-k", update.keyfile, f.Name())
+	cmd := exec.CommandContext(ctx, update.exe, "-k", keyfile, f.Name())
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &out
 	err = cmd.Run()
 	if err != nil {
-		return fmt.Errorf("%w: %s", err, out.String())
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(out.String()))
 	}
 	log.Println("Completed update", f.Name())
 	return nil
 
 }
-
-func (update *NsUpdate) update(data *nsUpdateData) error {
-	// Send non blocking.
-	select {
-	case update.queue <- data:
-		return nil
-	default:
-		return errors.New("update queue full")
-	}
-}
@@ -0,0 +1,394 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWork returns a batch of the given updates.
+func testWork(updates ...*nsUpdateData) map[string]*nsUpdateData {
+	work := make(map[string]*nsUpdateData)
+	for _, data := range updates {
+		work[data.hostname+" "+recordType(*data.ip)] = data
+	}
+	return work
+}
+
+func testUpdate(hostname, ip string, wildcard bool) *nsUpdateData {
+	addr := net.ParseIP(ip)
+	return &nsUpdateData{hostname, &addr, "203.0.113.1", "alice", wildcard}
+}
+
+func TestNsUpdateScripts(t *testing.T) {
+	records, _ := NewRecordStore("")
+	backend := &NsUpdateBackend{
+		server:  "ns.example.com",
+		zone:    "dyn.example.com",
+		ttl:     60,
+		records: records,
+	}
+	tests := []struct {
+		name     string
+		data     *nsUpdateData
+		expected []string
+	}{
+		{"ipv4", testUpdate("myhost", "203.0.113.5", false), []string{
+			"update delete myhost.dyn.example.com. A",
+			"update add myhost.dyn.example.com. 60 A 203.0.113.5",
+			"update delete *.myhost.dyn.example.com. A",
+		}},
+		{"ipv6 wildcard", testUpdate("myhost", "2001:db8::5", true), []string{
+			"update delete myhost.dyn.example.com. AAAA",
+			"update add myhost.dyn.example.com. 60 AAAA 2001:db8::5",
+			"update delete *.myhost.dyn.example.com. AAAA",
+			"update add *.myhost.dyn.example.com. 60 AAAA 2001:db8::5",
+		}},
+		{"invalid hostname", testUpdate("my host", "203.0.113.5", false), nil},
+	}
+	for _, test := range tests {
+		script, reverse := backend.scripts(testWork(test.data))
+		expected := append([]string{"server ns.example.com", "zone dyn.example.com"}, test.expected...)
+		expected = append(expected, "send", "")
+		if string(script) != strings.Join(expected, "\n") {
+			t.Errorf("%s: unexpected script:\n%s", test.name, script)
+		}
+		if len(reverse) != 0 {
+			t.Errorf("%s: unexpected reverse zone scripts", test.name)
+		}
+	}
+}
+
+// testNsUpdateExe writes a fake nsupdate, which appends the scripts to
+// logfile and exits with status.
+func testNsUpdateExe(t *testing.T, logfile string, status int) string {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	exe := filepath.Join(t.TempDir(), "nsupdate")
+	fake := "#!/bin/sh\ncat \"$3\" >> " + logfile + "\nexit " + strconv.Itoa(status) + "\n"
+	if err := ioutil.WriteFile(exe, []byte(fake), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return exe
+}
+
+func TestNsUpdateBackendProcess(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"applied", 0},
+		{"failed", 1},
+	}
+	for _, test := range tests {
+		logfile := filepath.Join(t.TempDir(), "log")
+		records, _ := NewRecordStore("")
+		backend, err := NewNsUpdateBackend(testNsUpdateExe(t, logfile, test.status), "ns.example.com", "key", "dyn.example.com", 60, nil, records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = backend.process(context.Background(), testWork(
+			testUpdate("home", "203.0.113.5", false),
+			testUpdate("home", "2001:db8::5", false),
+			testUpdate("cabin", "203.0.113.6", true),
+		))
+		if (err != nil) != (test.status != 0) {
+			t.Errorf("%s: unexpected result: %v", test.name, err)
+		}
+
+		// All updates are sent in one batch.
+		data, err := ioutil.ReadFile(logfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(data), "send\n"); n != 1 {
+			t.Errorf("%s: expected 1 batch, got %d:\n%s", test.name, n, data)
+		}
+		for _, expected := range []string{
+			"update add home.dyn.example.com. 60 A 203.0.113.5\n",
+			"update add home.dyn.example.com. 60 AAAA 2001:db8::5\n",
+			"update add cabin.dyn.example.com. 60 A 203.0.113.6\n",
+			"update add *.cabin.dyn.example.com. 60 A 203.0.113.6\n",
+		} {
+			if !strings.Contains(string(data), expected) {
+				t.Errorf("%s: batch does not contain %q:\n%s", test.name, expected, data)
+			}
+		}
+	}
+}
+
+func TestNsUpdateReverseFailure(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	dir := t.TempDir()
+	// The fake nsupdate logs all scripts and fails for the reverse zone,
+	// while the fail file exists.
+	exe := filepath.Join(dir, "nsupdate")
+	logfile := filepath.Join(dir, "log")
+	failfile := filepath.Join(dir, "fail")
+	fake := "#!/bin/sh\ncat \"$3\" >> " + logfile + "\n" +
+		"if grep -q in-addr.arpa \"$3\" && [ -e " + failfile + " ]; then exit 1; fi\n"
+	if err := ioutil.WriteFile(exe, []byte(fake), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(failfile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	reverse, err := NewReverseZones([]*ReverseZoneConfig{{Network: "203.0.113.0/24"}}, "ns.example.com", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _ := NewRecordStore("")
+	backend, err := NewNsUpdateBackend(exe, "ns.example.com", "key", "dyn.example.com", 60, reverse, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = backend.process(context.Background(), testWork(testUpdate("myhost", "203.0.113.5", false))); err != nil {
+		t.Fatalf("failing reverse zone should not fail the batch: %v", err)
+	}
+	os.Remove(failfile)
+	if err = backend.process(context.Background(), testWork(testUpdate("other", "203.0.113.6", false))); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scripts := strings.SplitAfter(string(data), "send\n")
+	// Forward, failed reverse, forward and reverse with the retried changes.
+	if len(scripts) != 5 || scripts[4] != "" {
+		t.Fatalf("unexpected scripts:\n%s", data)
+	}
+	for _, expected := range []string{
+		"update add 5.113.0.203.in-addr.arpa. 60 PTR myhost.dyn.example.com.\n",
+		"update add 6.113.0.203.in-addr.arpa. 60 PTR other.dyn.example.com.\n",
+	} {
+		if !strings.Contains(scripts[3], expected) {
+			t.Errorf("reverse script does not contain %q:\n%s", expected, scripts[3])
+		}
+	}
+	if len(backend.pending) != 0 {
+		t.Error("pending changes should be cleared")
+	}
+}
+
+func TestPtrChangesMerge(t *testing.T) {
+	now := time.Now()
+	name := "5.113.0.203.in-addr.arpa"
+	tests := []struct {
+		name     string
+		pending  func(ptrChanges)
+		batch    func(ptrChanges)
+		expected string
+	}{
+		{"set replaces", func(changes ptrChanges) {
+			changes.set(name, "home.dyn.example.com.", now)
+		}, func(changes ptrChanges) {
+			changes.set(name, "office.dyn.example.com.", now)
+		}, "update delete 5.113.0.203.in-addr.arpa. PTR\n" +
+			"update add 5.113.0.203.in-addr.arpa. 60 PTR office.dyn.example.com.\n"},
+		{"remove after set", func(changes ptrChanges) {
+			changes.set(name, "home.dyn.example.com.", now)
+		}, func(changes ptrChanges) {
+			changes.remove(name, "home.dyn.example.com.", now)
+		}, "update delete 5.113.0.203.in-addr.arpa. PTR home.dyn.example.com.\n"},
+		{"remove of other host", func(changes ptrChanges) {
+			changes.set(name, "home.dyn.example.com.", now)
+		}, func(changes ptrChanges) {
+			changes.remove(name, "office.dyn.example.com.", now)
+		}, "update delete 5.113.0.203.in-addr.arpa. PTR office.dyn.example.com.\n" +
+			"update delete 5.113.0.203.in-addr.arpa. PTR\n" +
+			"update add 5.113.0.203.in-addr.arpa. 60 PTR home.dyn.example.com.\n"},
+		{"repeated remove", func(changes ptrChanges) {
+			changes.remove(name, "home.dyn.example.com.", now)
+		}, func(changes ptrChanges) {
+			changes.remove(name, "home.dyn.example.com.", now)
+		}, "update delete 5.113.0.203.in-addr.arpa. PTR home.dyn.example.com.\n"},
+	}
+	for _, test := range tests {
+		pending, batch := make(ptrChanges), make(ptrChanges)
+		test.pending(pending)
+		test.batch(batch)
+		changes := make(ptrChanges)
+		changes.merge(pending)
+		changes.merge(batch)
+		var script bytes.Buffer
+		changes.write(&script, 60)
+		if script.String() != test.expected {
+			t.Errorf("%s: unexpected script:\n%s", test.name, script.String())
+		}
+	}
+}
+
+func TestPtrChangesExpire(t *testing.T) {
+	now := time.Now()
+	changes := make(ptrChanges)
+	changes.set("5.113.0.203.in-addr.arpa", "home.dyn.example.com.", now.Add(-2*ptrRetention))
+	changes.set("6.113.0.203.in-addr.arpa", "office.dyn.example.com.", now)
+	if n := changes.expire(now.Add(-ptrRetention)); n != 1 {
+		t.Errorf("expected 1 dropped change, got %d", n)
+	}
+	if _, ok := changes["6.113.0.203.in-addr.arpa"]; !ok || len(changes) != 1 {
+		t.Errorf("unexpected changes left: %v", changes)
+	}
+}
+
+// testBackend records the processed batches and fails with err.
+type testBackend struct {
+	batches []map[string]*nsUpdateData
+	err     error
+}
+
+func (backend *testBackend) process(ctx context.Context, work map[string]*nsUpdateData) error {
+	batch := make(map[string]*nsUpdateData)
+	for key, data := range work {
+		batch[key] = data
+	}
+	backend.batches = append(backend.batches, batch)
+	return backend.err
+}
+
+func TestNsUpdateStopFlushes(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		address string
+	}{
+		{"applied", nil, "203.0.113.5"},
+		{"failed", errors.New("server unreachable"), ""},
+	}
+	for _, test := range tests {
+		records := testRecordStore(t)
+		backend := &testBackend{err: test.err}
+		update := NewNsUpdate(backend, records, NewAuditLog("", 0))
+		go update.run()
+
+		if err := update.update(testUpdate("home", "203.0.113.5", false), testUpdate("home", "2001:db8::5", false)); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := update.stop(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: stop failed: %v", test.name, err)
+		}
+		if len(backend.batches) != 1 || len(backend.batches[0]) != 2 {
+			t.Fatalf("%s: expected one batch with 2 updates, got %v", test.name, backend.batches)
+		}
+
+		// The result is kept in the state file.
+		store, err := NewRecordStore(records.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := store.status("home").Records["A"]
+		if test.address == "" {
+			if status == nil || status.Address != nil || status.Error != test.err.Error() {
+				t.Errorf("%s: unexpected status %+v", test.name, status)
+			}
+		} else if status == nil || status.Address.String() != test.address {
+			t.Errorf("%s: unexpected status %+v", test.name, status)
+		}
+	}
+}
+
+func TestNsUpdateStopTimeout(t *testing.T) {
+	update := NewNsUpdate(&testBackend{}, testRecordStore(t), NewAuditLog("", 0))
+	// The worker is not running, so it never exits.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := update.stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"203.0.113.5", "5.113.0.203.in-addr.arpa"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+	for _, test := range tests {
+		if name := reverseName(net.ParseIP(test.ip)); name != test.expected {
+			t.Errorf("reverseName(%s) = %s, want %s", test.ip, name, test.expected)
+		}
+	}
+}
+
+func TestNewReverseZones(t *testing.T) {
+	tests := []struct {
+		network, zone string
+		expected      string
+	}{
+		{"203.0.113.0/24", "", "113.0.203.in-addr.arpa"},
+		{"10.0.0.0/8", "", "10.in-addr.arpa"},
+		{"2001:db8::/32", "", "8.b.d.0.1.0.0.2.ip6.arpa"},
+		{"2001:db8:1::/48", "", "1.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+		{"203.0.113.128/25", "128-255.113.0.203.in-addr.arpa", ""},
+		{"203.0.113.0/25", "", ""},
+		{"203.0.113.0/24", "113.0.203.in-addr.arpa.", "113.0.203.in-addr.arpa"},
+		{"203.0.113.0/24", "114.0.203.in-addr.arpa", ""},
+		{"invalid", "", ""},
+	}
+	for _, test := range tests {
+		zones, err := NewReverseZones([]*ReverseZoneConfig{{Network: test.network, Zone: test.zone}}, "ns.example.com", "key")
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s %s: expected error", test.network, test.zone)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", test.network, test.zone, err)
+			continue
+		}
+		if zones[0].zone != test.expected {
+			t.Errorf("%s %s: zone %s, want %s", test.network, test.zone, zones[0].zone, test.expected)
+		}
+	}
+
+	zones, err := NewReverseZones([]*ReverseZoneConfig{{Network: "2001:db8::/32"}, {Network: "2001:db8:1::/48"}}, "ns.example.com", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone := zones.find(net.ParseIP("2001:db8:1::1")); zone != zones[1] {
+		t.Error("expected most specific zone")
+	}
+	if zone := zones.find(net.ParseIP("203.0.113.1")); zone != nil {
+		t.Error("expected no zone")
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/longsleep/mydyns"
+	"github.com/miekg/dns"
+)
+
+// PowerDNSConfig defines the PowerDNS backend in the powerdns section of the
+// configuration file.
+type PowerDNSConfig struct {
+	URL     string `yaml:"url"`
+	Key     string `yaml:"key"`
+	Server  string `yaml:"server"`
+	Zone    string `yaml:"zone"`
+	Timeout string `yaml:"timeout"`
+}
+
+// powerDNSRRSet is a changed RRset in a PATCH request of the PowerDNS API.
+type powerDNSRRSet struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	TTL        int              `json:"ttl,omitempty"`
+	ChangeType string           `json:"changetype"`
+	Records    []powerDNSRecord `json:"records"`
+}
+
+type powerDNSRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+// PowerDNS applies the updates with the HTTP API of a PowerDNS Authoritative
+// server, by replacing the RRsets of the hosts.
+type PowerDNS struct {
+	url    string
+	key    string
+	origin string
+	ttl    int
+	client *http.Client
+}
+
+func NewPowerDNS(config *PowerDNSConfig, zone string, ttl int) (*PowerDNS, error) {
+	if config == nil {
+		return nil, errors.New("powerdns section required")
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("http or https URL required: %s", config.URL)
+	}
+	if config.Key == "" {
+		return nil, errors.New("key required")
+	}
+	server := config.Server
+	if server == "" {
+		server = "localhost"
+	}
+	zoneid := dns.Fqdn(zone)
+	if config.Zone != "" {
+		zoneid = config.Zone
+	}
+	timeout := 10 * time.Second
+	if config.Timeout != "" {
+		if timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	return &PowerDNS{
+		url:    strings.TrimSuffix(config.URL, "/") + "/api/v1/servers/" + url.PathEscape(server) + "/zones/" + url.PathEscape(zoneid),
+		key:    config.Key,
+		origin: dns.Fqdn(zone),
+		ttl:    ttl,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// process implements Backend. All RRsets of work are replaced with a single
+// request. The wildcard RRsets of hosts without the wildcard option are
+// deleted.
+func (pdns *PowerDNS) process(ctx context.Context, work map[string]*nsUpdateData) error {
+	var rrsets []*powerDNSRRSet
+	for _, data := range work {
+		if !mydyns.ValidHostname(data.hostname) {
+			log.Println("Skipping update of invalid hostname", data.hostname)
+			continue
+		}
+		name := data.hostname + "." + pdns.origin
+		rrset := &powerDNSRRSet{
+			Name:       name,
+			Type:       recordType(*data.ip),
+			TTL:        pdns.ttl,
+			ChangeType: "REPLACE",
+			Records:    []powerDNSRecord{{Content: data.ip.String()}},
+		}
+		wildcard := *rrset
+		wildcard.Name = "*." + name
+		if !data.wildcard {
+			wildcard.TTL = 0
+			wildcard.ChangeType = "DELETE"
+			wildcard.Records = []powerDNSRecord{}
+		}
+		rrsets = append(rrsets, rrset, &wildcard)
+	}
+	if len(rrsets) == 0 {
+		return nil
+	}
+	sort.Slice(rrsets, func(i, j int) bool {
+		if rrsets[i].Name != rrsets[j].Name {
+			return rrsets[i].Name < rrsets[j].Name
+		}
+		return rrsets[i].Type < rrsets[j].Type
+	})
+
+	payload, err := json.Marshal(map[string]interface{}{"rrsets": rrsets})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPatch, pdns.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mydynsd/"+version)
+	req.Header.Set("X-API-Key", pdns.key)
+	log.Printf("Processing %d updates with %s\n", len(work), pdns.url)
+	response, err := pdns.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// Errors have a JSON body with the error message.
+		var result struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &result) == nil && result.Error != "" {
+			return fmt.Errorf("powerdns returned %s: %s", response.Status, result.Error)
+		}
+		return fmt.Errorf("powerdns returned %s", response.Status)
+	}
+	log.Println("Completed update", pdns.url)
+	return nil
+}
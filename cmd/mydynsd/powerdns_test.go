@@ -0,0 +1,171 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewPowerDNS(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *PowerDNSConfig
+		expected string
+		err      bool
+	}{
+		{"defaults", &PowerDNSConfig{URL: "http://127.0.0.1:8081/", Key: "key"},
+			"http://127.0.0.1:8081/api/v1/servers/localhost/zones/dyn.example.com.", false},
+		{"server and zone", &PowerDNSConfig{URL: "https://pdns.example.com/prefix", Key: "key", Server: "other", Zone: "dyn.example.com.:variant"},
+			"https://pdns.example.com/prefix/api/v1/servers/other/zones/dyn.example.com.:variant", false},
+		{"no section", nil, "", true},
+		{"no key", &PowerDNSConfig{URL: "http://127.0.0.1:8081"}, "", true},
+		{"no scheme", &PowerDNSConfig{URL: "127.0.0.1:8081", Key: "key"}, "", true},
+		{"unsupported scheme", &PowerDNSConfig{URL: "ftp://127.0.0.1", Key: "key"}, "", true},
+		{"invalid timeout", &PowerDNSConfig{URL: "http://127.0.0.1:8081", Key: "key", Timeout: "soon"}, "", true},
+	}
+	for _, test := range tests {
+		pdns, err := NewPowerDNS(test.config, "dyn.example.com", 60)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if pdns.url != test.expected {
+			t.Errorf("%s: got %q, want %q", test.name, pdns.url, test.expected)
+		}
+	}
+}
+
+// powerDNSStub records the requests to the PowerDNS API and answers them
+// with status and body.
+type powerDNSStub struct {
+	*httptest.Server
+	status   int
+	body     string
+	requests []*http.Request
+	payloads []string
+}
+
+func newPowerDNSStub(t *testing.T) *powerDNSStub {
+	stub := &powerDNSStub{status: http.StatusNoContent}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := ioutil.ReadAll(r.Body)
+		stub.requests = append(stub.requests, r)
+		stub.payloads = append(stub.payloads, string(payload))
+		w.WriteHeader(stub.status)
+		w.Write([]byte(stub.body))
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func newTestPowerDNS(t *testing.T, stub *powerDNSStub) *PowerDNS {
+	pdns, err := NewPowerDNS(&PowerDNSConfig{URL: stub.URL, Key: "secret key"}, "dyn.example.com", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pdns
+}
+
+func TestPowerDNSProcess(t *testing.T) {
+	stub := newPowerDNSStub(t)
+	pdns := newTestPowerDNS(t, stub)
+
+	work := testWork(testUpdate("home", "203.0.113.5", true), testUpdate("office", "2001:db8::1", false))
+	if err := pdns.process(context.Background(), work); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(stub.requests))
+	}
+	r := stub.requests[0]
+	if r.Method != http.MethodPatch {
+		t.Errorf("unexpected method %s", r.Method)
+	}
+	if r.URL.Path != "/api/v1/servers/localhost/zones/dyn.example.com." {
+		t.Errorf("unexpected path %s", r.URL.Path)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "secret key" {
+		t.Errorf("unexpected X-API-Key %q", key)
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("unexpected Content-Type %q", contentType)
+	}
+	expected := `{"rrsets":[` +
+		`{"name":"*.home.dyn.example.com.","type":"A","ttl":60,"changetype":"REPLACE","records":[{"content":"203.0.113.5","disabled":false}]},` +
+		`{"name":"*.office.dyn.example.com.","type":"AAAA","changetype":"DELETE","records":[]},` +
+		`{"name":"home.dyn.example.com.","type":"A","ttl":60,"changetype":"REPLACE","records":[{"content":"203.0.113.5","disabled":false}]},` +
+		`{"name":"office.dyn.example.com.","type":"AAAA","ttl":60,"changetype":"REPLACE","records":[{"content":"2001:db8::1","disabled":false}]}` +
+		`]}`
+	if stub.payloads[0] != expected {
+		t.Errorf("unexpected payload:\n%s\nwant:\n%s", stub.payloads[0], expected)
+	}
+
+	// Invalid hostnames are never sent.
+	if err := pdns.process(context.Background(), testWork(testUpdate("-invalid", "203.0.113.5", false))); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.requests) != 1 {
+		t.Error("request sent without valid updates")
+	}
+}
+
+func TestPowerDNSErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		expected string
+	}{
+		{"ok", http.StatusOK, "", ""},
+		{"no content", http.StatusNoContent, "", ""},
+		{"error message", http.StatusUnprocessableEntity, `{"error": "RRset home.dyn.example.com. IN A: Conflicts with pre-existing RRset"}`,
+			"powerdns returned 422 Unprocessable Entity: RRset home.dyn.example.com. IN A: Conflicts with pre-existing RRset"},
+		{"no message", http.StatusInternalServerError, "oops", "powerdns returned 500 Internal Server Error"},
+		{"not found", http.StatusNotFound, `{"error": ""}`, "powerdns returned 404 Not Found"},
+		{"redirect", http.StatusNotModified, "", "powerdns returned 304 Not Modified"},
+	}
+	stub := newPowerDNSStub(t)
+	pdns := newTestPowerDNS(t, stub)
+	for _, test := range tests {
+		stub.status = test.status
+		stub.body = test.body
+		err := pdns.process(context.Background(), testWork(testUpdate("home", "203.0.113.5", false)))
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.expected)
+		}
+	}
+}
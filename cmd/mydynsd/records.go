@@ -0,0 +1,227 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/longsleep/mydyns"
+)
+
+// recordStatus is what we know about a single record of a host.
+type recordStatus struct {
+	Address  net.IP     `json:"address,omitempty"`
+	Updated  *time.Time `json:"updated,omitempty"`
+	Source   string     `json:"source,omitempty"`
+	Pending  net.IP     `json:"pending,omitempty"`
+	Queued   *time.Time `json:"queued,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Failed   *time.Time `json:"failed,omitempty"`
+	Failures int        `json:"failures,omitempty"`
+}
+
+// recordFailure is a failed update with the number of consecutive failures
+// of the record.
+type recordFailure struct {
+	data     *nsUpdateData
+	failures int
+}
+
+// hostStatus is the status of all records of a host.
+type hostStatus struct {
+	Name    string                   `json:"name"`
+	Unicode string                   `json:"unicode,omitempty"`
+	Records map[string]*recordStatus `json:"records"`
+}
+
+// RecordStore keeps track of the records of all hosts, from queueing an
+// update until it was applied or failed. When a file is given, the applied
+// records are kept across restarts.
+type RecordStore struct {
+	sync.Mutex
+	file  string
+	hosts map[string]map[string]*recordStatus
+}
+
+func NewRecordStore(file string) (*RecordStore, error) {
+	store := &RecordStore{
+		file:  file,
+		hosts: make(map[string]map[string]*recordStatus),
+	}
+	if file == "" {
+		return store, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &store.hosts); err != nil {
+		return nil, err
+	}
+	// Pending updates are gone with the previous process.
+	for _, records := range store.hosts {
+		for _, record := range records {
+			record.Pending = nil
+			record.Queued = nil
+		}
+	}
+	log.Printf("Loaded state of %d hosts\n", len(store.hosts))
+	return store, nil
+}
+
+// recordType returns the DNS record type for ip.
+func recordType(ip net.IP) string {
+	if ip.To4() != nil {
+		return "A"
+	}
+	return "AAAA"
+}
+
+// record returns the status of the record of hostname for ip, creating it if
+// needed. The caller must hold the lock.
+func (store *RecordStore) record(hostname string, ip net.IP) *recordStatus {
+	records, ok := store.hosts[hostname]
+	if !ok {
+		records = make(map[string]*recordStatus)
+		store.hosts[hostname] = records
+	}
+	t := recordType(ip)
+	record, ok := records[t]
+	if !ok {
+		record = &recordStatus{}
+		records[t] = record
+	}
+	return record
+}
+
+// queued marks the records of batch as pending. The caller must hold the
+// lock.
+func (store *RecordStore) queued(batch []*nsUpdateData) {
+	now := time.Now()
+	for _, data := range batch {
+		record := store.record(data.hostname, *data.ip)
+		record.Pending = *data.ip
+		record.Queued = &now
+	}
+}
+
+// applied sets the records of work as current.
+func (store *RecordStore) applied(work map[string]*nsUpdateData) {
+	now := time.Now()
+	store.Lock()
+	defer store.Unlock()
+	for _, data := range work {
+		record := store.record(data.hostname, *data.ip)
+		record.Address = *data.ip
+		record.Updated = &now
+		record.Source = data.source
+		if record.Pending.Equal(*data.ip) {
+			record.Pending = nil
+			record.Queued = nil
+		}
+		record.Error = ""
+		record.Failed = nil
+		record.Failures = 0
+	}
+	store.save()
+}
+
+// failed records err for the records of work and returns the failures.
+func (store *RecordStore) failed(work map[string]*nsUpdateData, err error) []*recordFailure {
+	now := time.Now()
+	store.Lock()
+	defer store.Unlock()
+	failed := make([]*recordFailure, 0, len(work))
+	for _, data := range work {
+		record := store.record(data.hostname, *data.ip)
+		record.Error = err.Error()
+		record.Failed = &now
+		record.Failures++
+		failed = append(failed, &recordFailure{data, record.Failures})
+	}
+	store.save()
+	return failed
+}
+
+// address returns the current address of the record of hostname with the
+// type of ip.
+func (store *RecordStore) address(hostname string, ip net.IP) net.IP {
+	store.Lock()
+	defer store.Unlock()
+	if record, ok := store.hosts[hostname][recordType(ip)]; ok {
+		return record.Address
+	}
+	return nil
+}
+
+// status returns a copy of the status of hostname.
+func (store *RecordStore) status(hostname string) *hostStatus {
+	store.Lock()
+	defer store.Unlock()
+	status := &hostStatus{
+		Name:    hostname,
+		Unicode: unicodeName(hostname),
+		Records: make(map[string]*recordStatus),
+	}
+	for t, record := range store.hosts[hostname] {
+		r := *record
+		status.Records[t] = &r
+	}
+	return status
+}
+
+// save writes all records to the file of the store. The caller must hold the
+// lock.
+func (store *RecordStore) save() {
+	if store.file == "" {
+		return
+	}
+	data, err := json.Marshal(store.hosts)
+	if err == nil {
+		err = mydyns.WriteFileAtomic(store.file, data, 0600)
+	}
+	if err != nil {
+		log.Println("Failed to save state", err)
+	}
+}
+
+// addresses returns the current addresses of all hosts.
+func (store *RecordStore) addresses() map[string][]net.IP {
+	store.Lock()
+	defer store.Unlock()
+	result := make(map[string][]net.IP)
+	for hostname, records := range store.hosts {
+		for _, t := range []string{"A", "AAAA"} {
+			if record, ok := records[t]; ok && record.Address != nil {
+				result[hostname] = append(result[hostname], record.Address)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,133 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// testRecordStore returns a record store with a state file, which has the
+// given updates applied.
+func testRecordStore(t *testing.T, updates ...*nsUpdateData) *RecordStore {
+	store, err := NewRecordStore(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) > 0 {
+		store.applied(testWork(updates...))
+	}
+	return store
+}
+
+func TestRecordStoreStatus(t *testing.T) {
+	store := testRecordStore(t)
+	update := testUpdate("home", "203.0.113.5", false)
+
+	steps := []struct {
+		name     string
+		apply    func()
+		address  string
+		pending  string
+		failures int
+	}{
+		{"queued", func() {
+			store.Lock()
+			store.queued([]*nsUpdateData{update})
+			store.Unlock()
+		}, "<nil>", "203.0.113.5", 0},
+		{"failed", func() { store.failed(testWork(update), errors.New("refused")) }, "<nil>", "203.0.113.5", 1},
+		{"failed again", func() { store.failed(testWork(update), errors.New("refused")) }, "<nil>", "203.0.113.5", 2},
+		{"applied", func() { store.applied(testWork(update)) }, "203.0.113.5", "<nil>", 0},
+	}
+	for _, step := range steps {
+		step.apply()
+		record := store.status("home").Records["A"]
+		if record == nil {
+			t.Fatalf("%s: no record", step.name)
+		}
+		if record.Address.String() != step.address || record.Pending.String() != step.pending || record.Failures != step.failures {
+			t.Errorf("%s: unexpected record %+v", step.name, record)
+		}
+	}
+
+	// Pending updates are not restored, applied ones are.
+	store.Lock()
+	store.queued([]*nsUpdateData{testUpdate("home", "203.0.113.6", false)})
+	store.save()
+	store.Unlock()
+	restored, err := NewRecordStore(store.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record := restored.status("home").Records["A"]; record.Address.String() != "203.0.113.5" || record.Pending != nil {
+		t.Errorf("unexpected restored record %+v", record)
+	}
+}
+
+func TestHostsStatus(t *testing.T) {
+	setupTestService(t)
+	records = testRecordStore(t, testUpdate("home", "203.0.113.5", false), testUpdate("office", "203.0.113.6", false))
+	t.Cleanup(func() { records = nil })
+	token, _, err := createToken(testRequest(), "alice", "secret", "home")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		username string
+		password string
+		basic    bool
+		status   int
+		hosts    []string
+	}{
+		{"token", token, "", "", false, http.StatusOK, []string{"home"}},
+		{"basic auth", "", "alice", "secret", true, http.StatusOK, []string{"home"}},
+		{"wrong password", "", "alice", "wrong", true, http.StatusForbidden, nil},
+		{"invalid token", "invalid", "", "", false, http.StatusForbidden, nil},
+		{"no auth", "", "", "", false, http.StatusUnauthorized, nil},
+	}
+	for _, test := range tests {
+		result, err := hostsStatus(testRequest(), test.token, test.username, test.password, test.basic)
+		if test.status != http.StatusOK {
+			if status := serviceErrorStatus(err); status != test.status {
+				t.Errorf("%s: got status %d, want %d: %v", test.name, status, test.status, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(result) != len(test.hosts) {
+			t.Errorf("%s: got %d hosts, want %d", test.name, len(result), len(test.hosts))
+			continue
+		}
+		for idx, status := range result {
+			if status.Name != test.hosts[idx] || status.Records["A"] == nil || status.Records["A"].Address.String() != "203.0.113.5" {
+				t.Errorf("%s: unexpected status %+v", test.name, status)
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/longsleep/mydyns"
+)
+
+// RegistrationConfig defines the registration section of the configuration
+// file with the policy for hosts registered by users.
+type RegistrationConfig struct {
+	Quota     int            `yaml:"quota"`
+	Quotas    map[string]int `yaml:"quotas"`
+	Pattern   string         `yaml:"pattern"`
+	MinLength int            `yaml:"min-length"`
+	MaxLength int            `yaml:"max-length"`
+	Reserved  []string       `yaml:"reserved"`
+}
+
+// Registration lets users register new hosts for themselves, within their
+// quota and the naming policy. Registered hosts are written to the hosts
+// database.
+type Registration struct {
+	files     *DatabaseFiles
+	quota     int
+	quotas    map[string]int
+	pattern   *regexp.Regexp
+	minLength int
+	maxLength int
+	reserved  map[string]bool
+}
+
+func NewRegistration(config *RegistrationConfig, files *DatabaseFiles) (*Registration, error) {
+	reg := &Registration{
+		files:     files,
+		quota:     config.Quota,
+		quotas:    config.Quotas,
+		minLength: config.MinLength,
+		maxLength: config.MaxLength,
+		reserved:  make(map[string]bool),
+	}
+	if reg.quota == 0 {
+		reg.quota = 3
+	}
+	if reg.minLength == 0 {
+		reg.minLength = 1
+	}
+	if reg.maxLength == 0 {
+		reg.maxLength = 63
+	}
+	if config.Pattern != "" {
+		pattern, err := regexp.Compile(config.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("registration pattern: %w", err)
+		}
+		reg.pattern = pattern
+	}
+	for _, name := range config.Reserved {
+		// Reserved names are compared like registered names.
+		if normalized, err := mydyns.NormalizeHostname(name); err == nil {
+			name = normalized
+		}
+		reg.reserved[strings.ToLower(name)] = true
+	}
+	return reg, nil
+}
+
+// quotaOf returns the number of hosts user may have.
+func (reg *Registration) quotaOf(user string) int {
+	if quota, ok := reg.quotas[user]; ok {
+		return quota
+	}
+	return reg.quota
+}
+
+// check validates hostname against the naming policy and returns it
+// normalized relative to the zone, as it is stored in the hosts database.
+func (reg *Registration) check(value string) (string, error) {
+	hostnames, err := parseHostnames(value)
+	if err != nil {
+		return "", err
+	}
+	if len(hostnames) != 1 {
+		return "", newServiceError(http.StatusBadRequest, "invalid_hostname", "single hostname required")
+	}
+	hostname := hostnames[0]
+	if len(hostname) < reg.minLength || len(hostname) > reg.maxLength {
+		return "", newServiceError(http.StatusBadRequest, "invalid_hostname", "hostname must have %d to %d characters", reg.minLength, reg.maxLength)
+	}
+	if reg.pattern != nil && !reg.pattern.MatchString(hostname) {
+		return "", newServiceError(http.StatusBadRequest, "invalid_hostname", "hostname does not match %s", reg.pattern)
+	}
+	if reg.reserved[hostname] {
+		return "", newServiceError(http.StatusForbidden, "reserved_hostname", "hostname is reserved")
+	}
+	return hostname, nil
+}
+
+// register authenticates user and adds hostname as new host of the user. It
+// returns the normalized name of the registered host.
+func (reg *Registration) register(r *http.Request, username, password, hostname string) (string, error) {
+	client := requestAddress(r)
+	if err := checkLimit("ip", client.String()); err != nil {
+		return "", err
+	}
+	if err := checkPassword(client, username, password); err != nil {
+		return "", err
+	}
+	if err := checkLimit("user", username); err != nil {
+		return "", err
+	}
+	if hostname == "" {
+		return "", newServiceError(http.StatusBadRequest, "hostname_required", "hostname parameter required")
+	}
+	hostname, err := reg.check(hostname)
+	if err != nil {
+		return "", err
+	}
+
+	quota := reg.quotaOf(username)
+	err = modifyDatabases(reg.files, func(db *adminDatabases) error {
+		if _, ok := db.hosts.Users(hostname); ok {
+			return newServiceError(http.StatusConflict, "host_exists", "host already exists")
+		}
+		// Names below hosts of other users are theirs to manage.
+		for parent := hostname; strings.Contains(parent, "."); {
+			parent = parent[strings.Index(parent, ".")+1:]
+			if _, ok := db.hosts.Users(parent); ok && !db.hosts.CheckUser(parent, username) {
+				return newServiceError(http.StatusForbidden, "access_denied", "host %s belongs to another user", mydyns.UnicodeHostname(parent))
+			}
+		}
+		count := 0
+		for _, host := range db.hosts.Hosts() {
+			if db.hosts.CheckUser(host, username) {
+				count++
+			}
+		}
+		if count >= quota {
+			return newServiceError(http.StatusForbidden, "quota_exceeded", "quota of %d hosts exceeded", quota)
+		}
+		db.hosts.Set(hostname, []string{username})
+		db.hostsChanged = true
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Println("Host registered by", username, mydyns.UnicodeHostname(hostname))
+	audit.record(&auditEvent{
+		Action: auditRegister,
+		User:   username,
+		Host:   hostname,
+		Client: client.String(),
+	})
+	return hostname, nil
+}
+
+// ServeHTTP implements the /register end point.
+func (reg *Registration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// Basic auth is required.
+	username, password, ok := getBasicAuth(r)
+	if !ok {
+		http.Error(w, "basic auth required", http.StatusForbidden)
+		return
+	}
+
+	r.ParseForm()
+	if _, err := reg.register(r, username, password, r.Form.Get("hostname")); err != nil {
+		legacyError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "registered\n")
+
+}
@@ -0,0 +1,115 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRegistrationCheck(t *testing.T) {
+	dnszone = "example.com"
+	reg, err := NewRegistration(&RegistrationConfig{
+		Pattern:   "^[a-z0-9.-]+$",
+		MinLength: 3,
+		MaxLength: 20,
+		Reserved:  []string{"WWW", "Bücher"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value    string
+		expected string
+		status   int
+	}{
+		{"myhost", "myhost", 0},
+		{"MyHost", "myhost", 0},
+		{"myhost.example.com.", "myhost", 0},
+		{"myhost.example.com", "myhost", 0},
+		{"mail.myhost", "mail.myhost", 0},
+		{"müller", "xn--mller-kva", 0},
+		{"ab", "", http.StatusBadRequest},
+		{"ab.example.com", "", http.StatusBadRequest},
+		{"averyveryverylonghostname", "", http.StatusBadRequest},
+		{"a,b", "", http.StatusBadRequest},
+		{"my_host", "", http.StatusBadRequest},
+		{"myhost.example.org.", "", http.StatusBadRequest},
+		{"www", "", http.StatusForbidden},
+		{"WWW.example.com", "", http.StatusForbidden},
+		{"bücher", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		hostname, err := reg.check(test.value)
+		if status := serviceErrorStatus(err); status != test.status {
+			t.Errorf("%q: status %d, want %d (%v)", test.value, status, test.status, err)
+			continue
+		}
+		if hostname != test.expected {
+			t.Errorf("%q: got %q, want %q", test.value, hostname, test.expected)
+		}
+	}
+}
+
+func TestRegisterNormalizedHostname(t *testing.T) {
+	files := setupTestService(t)
+	reg, err := NewRegistration(&RegistrationConfig{}, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reg.register(testRequest(), "alice", "secret", "Cabin.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	dblock.RLock()
+	ok := hosts.CheckUser("cabin", "alice")
+	dblock.RUnlock()
+	if !ok {
+		t.Error("host not registered with normalized name")
+	}
+	if _, err = reg.register(testRequest(), "alice", "secret", "CABIN"); serviceErrorStatus(err) != http.StatusConflict {
+		t.Errorf("expected existing host to conflict, got %v", err)
+	}
+}
+
+func TestRegisterBelowOtherUsersHost(t *testing.T) {
+	files := setupTestService(t)
+	reg, err := NewRegistration(&RegistrationConfig{Quota: 10}, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, hostname string
+		status         int
+	}{
+		{"bob", "mail.home", http.StatusForbidden},
+		{"bob", "a.b.home", http.StatusForbidden},
+		{"bob", "mail.home.example.com.", http.StatusForbidden},
+		{"alice", "mail.home", 0},
+		{"bob", "mail.office", 0},
+		{"bob", "x.unregistered", 0},
+		{"alice", "deep.mail.office", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		_, err := reg.register(testRequest(), test.user, "secret", test.hostname)
+		if status := serviceErrorStatus(err); status != test.status {
+			t.Errorf("%s %s: status %d, want %d (%v)", test.user, test.hostname, status, test.status, err)
+		}
+	}
+}
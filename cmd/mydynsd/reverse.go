@@ -0,0 +1,134 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ReverseZoneConfig defines a reverse zone in the reverse section of the
+// configuration file.
+type ReverseZoneConfig struct {
+	Network string `yaml:"network"`
+	Zone    string `yaml:"zone"`
+	Server  string `yaml:"server"`
+	Key     string `yaml:"key"`
+}
+
+// ReverseZone is a in-addr.arpa or ip6.arpa zone where PTR records are
+// maintained for the addresses of hosts in its network.
+type ReverseZone struct {
+	network *net.IPNet
+	zone    string
+	server  string
+	keyfile string
+}
+
+func NewReverseZone(config *ReverseZoneConfig, server, keyfile string) (*ReverseZone, error) {
+	_, network, err := net.ParseCIDR(config.Network)
+	if err != nil {
+		return nil, fmt.Errorf("reverse zone %s: %w", config.Network, err)
+	}
+	zone := strings.ToLower(strings.TrimSuffix(config.Zone, "."))
+	if zone == "" {
+		if zone = reverseZoneName(network); zone == "" {
+			return nil, fmt.Errorf("reverse zone %s: zone required for networks not on a label boundary", config.Network)
+		}
+	} else if !strings.HasSuffix(reverseName(network.IP), "."+zone) {
+		return nil, fmt.Errorf("reverse zone %s: network is not in zone %s", config.Network, zone)
+	}
+	if config.Server != "" {
+		server = config.Server
+	}
+	if config.Key != "" {
+		keyfile = config.Key
+	}
+	return &ReverseZone{
+		network: network,
+		zone:    zone,
+		server:  server,
+		keyfile: keyfile,
+	}, nil
+}
+
+// ReverseZones are all configured reverse zones.
+type ReverseZones []*ReverseZone
+
+// NewReverseZones creates the reverse zones of configs. Zones without their
+// own server and key use the given ones of the forward zone.
+func NewReverseZones(configs []*ReverseZoneConfig, server, keyfile string) (ReverseZones, error) {
+	var zones ReverseZones
+	for _, config := range configs {
+		zone, err := NewReverseZone(config, server, keyfile)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// find returns the zone with the most specific network containing ip, or nil
+// if there is none.
+func (zones ReverseZones) find(ip net.IP) *ReverseZone {
+	var result *ReverseZone
+	var length int
+	for _, zone := range zones {
+		if !zone.network.Contains(ip) {
+			continue
+		}
+		if ones, _ := zone.network.Mask.Size(); result == nil || ones > length {
+			result, length = zone, ones
+		}
+	}
+	return result
+}
+
+// reverseName returns the name of the PTR record of ip, without trailing dot.
+func reverseName(ip net.IP) string {
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		for idx := len(ip4) - 1; idx >= 0; idx-- {
+			labels = append(labels, fmt.Sprintf("%d", ip4[idx]))
+		}
+		return strings.Join(append(labels, "in-addr", "arpa"), ".")
+	}
+	ip6 := ip.To16()
+	for idx := len(ip6) - 1; idx >= 0; idx-- {
+		labels = append(labels, fmt.Sprintf("%x", ip6[idx]&0xf), fmt.Sprintf("%x", ip6[idx]>>4))
+	}
+	return strings.Join(append(labels, "ip6", "arpa"), ".")
+}
+
+// reverseZoneName returns the name of the reverse zone of network, or an
+// empty string if the prefix length does not end on a label boundary.
+func reverseZoneName(network *net.IPNet) string {
+	ones, bits := network.Mask.Size()
+	labels := strings.Split(reverseName(network.IP), ".")
+	// Labels of the address, without the in-addr.arpa or ip6.arpa suffix.
+	count := len(labels) - 2
+	size := bits / count
+	if ones%size != 0 {
+		return ""
+	}
+	return strings.Join(labels[count-ones/size:], ".")
+}
@@ -0,0 +1,457 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/longsleep/mydyns"
+)
+
+// serviceError is an error of the token and update service with a HTTP status
+// code and a stable machine-readable error code. Rate limit errors tell when
+// to retry.
+type serviceError struct {
+	status  int
+	code    string
+	message string
+	retry   time.Duration
+}
+
+func (err *serviceError) Error() string {
+	return err.message
+}
+
+func newServiceError(status int, code string, format string, a ...interface{}) error {
+	return &serviceError{status, code, fmt.Sprintf(format, a...), 0}
+}
+
+// Host results of updates.
+const (
+	hostAccepted     = "accepted"
+	hostAccessDenied = "access_denied"
+)
+
+// hostResult is the result of an update for a single host.
+type hostResult struct {
+	Name    string `json:"name"`
+	Unicode string `json:"unicode,omitempty"`
+	Status  string `json:"status"`
+}
+
+// updateResult is the result of an update or check request.
+type updateResult struct {
+	IP    net.IP       `json:"ip"`
+	Hosts []hostResult `json:"hosts,omitempty"`
+}
+
+// createToken authenticates user and creates a token to update the given
+// comma-separated hostnames for the request r.
+func createToken(r *http.Request, username, password, hostname string) (string, []string, error) {
+	client := requestAddress(r)
+	if err := checkLimit("ip", client.String()); err != nil {
+		return "", nil, err
+	}
+	if err := checkPassword(client, username, password); err != nil {
+		return "", nil, err
+	}
+	if err := checkLimit("user", username); err != nil {
+		return "", nil, err
+	}
+
+	if hostname == "" {
+		return "", nil, newServiceError(http.StatusBadRequest, "hostname_required", "hostname parameter required")
+	}
+
+	// Validate hostnames, several hosts can be given comma-separated.
+	hostnames, err := parseHostnames(hostname)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Block when we are reloading things.
+	dblock.RLock()
+
+	// The user might have been disabled since the password check.
+	if err := checkUser(client, username, hostnames); err != nil {
+		dblock.RUnlock()
+		return "", nil, err
+	}
+
+	// Validate hostname access in users database.
+	for _, hostname := range hostnames {
+		if !hosts.CheckUser(hostname, username) {
+			dblock.RUnlock()
+			authFailed(client, username, "access denied", hostname)
+			return "", nil, newServiceError(http.StatusForbidden, "access_denied", "access denied")
+		}
+	}
+
+	// Prepare token data.
+	data := mydyns.NewTokenData(hostnames, username, security.Secret(username))
+
+	// Releas lock.
+	dblock.RUnlock()
+
+	// Encode token.
+	token, err := secret.Encode(mydyns.TokenName, data)
+	if err != nil {
+		log.Println("Error while creating token", err)
+		return "", nil, newServiceError(http.StatusInternalServerError, "token_failed", "failed to create token: %s", err)
+	}
+	log.Println("Token created by", username, displayHostnames(hostnames))
+	for _, hostname := range hostnames {
+		audit.record(&auditEvent{
+			Action: auditToken,
+			User:   username,
+			Host:   hostname,
+			Client: client.String(),
+		})
+	}
+	return token, hostnames, nil
+}
+
+// parseHostnames splits value into host names, validates them and returns
+// them normalized relative to the zone.
+func parseHostnames(value string) ([]string, error) {
+	var hostnames []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		hostname, err := relativeHostname(name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[hostname] {
+			return nil, newServiceError(http.StatusBadRequest, "invalid_hostname", "duplicate hostname %s", hostname)
+		}
+		seen[hostname] = true
+		hostnames = append(hostnames, hostname)
+	}
+	return hostnames, nil
+}
+
+// relativeHostname returns name in lower case punycode and relative to the
+// zone. Names ending with the zone are made relative, other names with a
+// trailing dot are not in the zone.
+func relativeHostname(name string) (string, error) {
+	fqdn := strings.HasSuffix(name, ".")
+	name, err := mydyns.NormalizeHostname(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return "", newServiceError(http.StatusBadRequest, "invalid_hostname", "invalid hostname")
+	}
+	suffix := "." + dnszone
+	switch {
+	case strings.HasSuffix(name, suffix):
+		name = strings.TrimSuffix(name, suffix)
+	case fqdn:
+		return "", newServiceError(http.StatusBadRequest, "invalid_hostname", "hostname not in zone %s", dnszone)
+	}
+	if !mydyns.ValidHostname(name) || len(name)+len(suffix) > mydyns.MaxHostnameLength {
+		return "", newServiceError(http.StatusBadRequest, "invalid_hostname", "invalid hostname")
+	}
+	return name, nil
+}
+
+// updateHosts validates token and sets the address myip for all hosts of the
+// token. An empty myip or auto uses the address of the request r. When check
+// is set, only the address is returned without changing anything.
+func updateHosts(r *http.Request, token, myip string, check bool) (*updateResult, error) {
+	// Validate token.
+	if token == "" {
+		return nil, newServiceError(http.StatusBadRequest, "token_required", "token parameter required")
+	}
+	source := requestAddress(r)
+	if err := checkLimit("ip", source.String()); err != nil {
+		return nil, err
+	}
+	if err := checkLocked(source, ""); err != nil {
+		return nil, err
+	}
+	var data mydyns.TokenData
+	if err := secret.Decode(mydyns.TokenName, token, &data); err != nil {
+		tokenFailed(source, "", "invalid token")
+		return nil, newServiceError(http.StatusForbidden, "invalid_token", "invalid token: %s", err)
+	}
+	if err := checkLimit("user", data.User); err != nil {
+		return nil, err
+	}
+
+	hostnames := data.Hostnames()
+
+	// Read lock so we hold, when we are currently reloading things.
+	dblock.RLock()
+	defer dblock.RUnlock()
+
+	// Tokens of disabled or deleted users are no longer valid.
+	if err := checkUser(source, data.User, hostnames); err != nil {
+		return nil, err
+	}
+
+	// Validate security entry.
+	if !security.Check(data.Security, data.User) {
+		tokenFailed(source, data.User, "invalid security code", hostnames...)
+		return nil, newServiceError(http.StatusForbidden, "invalid_security_code", "invalid security code")
+	}
+
+	// Validate hostname access in users database. Tokens for several hosts
+	// update all hosts which the user may still access.
+	result := &updateResult{}
+	var allowed []string
+	for _, hostname := range hostnames {
+		status := hostAccessDenied
+		if hosts.CheckUser(hostname, data.User) {
+			status = hostAccepted
+			allowed = append(allowed, hostname)
+		}
+		result.Hosts = append(result.Hosts, hostResult{hostname, unicodeName(hostname), status})
+	}
+	if len(allowed) == 0 {
+		authFailed(source, data.User, "access denied", hostnames...)
+		return nil, newServiceError(http.StatusForbidden, "access_denied", "access denied")
+	}
+
+	// Get IP.
+	var ip net.IP
+	if myip == "" || myip == "auto" {
+		ip = source
+	} else {
+		ip = net.ParseIP(myip)
+	}
+	// Validate IP.
+	if ip == nil || !ip.IsGlobalUnicast() {
+		return nil, newServiceError(http.StatusBadRequest, "invalid_ip", "invalid ip")
+	} else if isPrivateNetwork(ip) && !allowPrivate {
+		return nil, newServiceError(http.StatusBadRequest, "private_ip", "private ip not allowed")
+	}
+	result.IP = ip
+
+	if check {
+		result.Hosts = nil
+		return result, nil
+	}
+
+	// Take from the limits of all hosts only if none of them is exceeded.
+	if err := checkLimit("host", allowed...); err != nil {
+		return nil, err
+	}
+
+	// Queue changes of all hosts, together with hosts which get their address
+	// from the prefix of these hosts. Wildcard records are updated with the
+	// records of their host.
+	var batch []*nsUpdateData
+	for _, hostname := range allowed {
+		batch = append(batch, &nsUpdateData{hostname, &ip, source.String(), data.User, hosts.Options(hostname).Wildcard})
+		for _, host := range hosts.Delegated(hostname) {
+			options := hosts.Options(host)
+			if delegated := options.DelegatedAddress(ip); delegated != nil {
+				batch = append(batch, &nsUpdateData{host, &delegated, source.String(), data.User, options.Wildcard})
+			}
+		}
+	}
+	if err := update.update(batch...); err != nil {
+		log.Println("Update failed", err)
+		return nil, newServiceError(http.StatusServiceUnavailable, "update_failed", "update failed: %s", err)
+	}
+	for _, entry := range batch {
+		log.Println("Queued update", mydyns.UnicodeHostname(entry.hostname), *entry.ip)
+	}
+
+	return result, nil
+}
+
+// unicodeName returns the Unicode form of the internationalized hostname for
+// responses, or an empty string if it is the same as hostname.
+func unicodeName(hostname string) string {
+	if name := mydyns.UnicodeHostname(hostname); name != hostname {
+		return name
+	}
+	return ""
+}
+
+// displayHostnames returns the Unicode form of hostnames for logs.
+func displayHostnames(hostnames []string) string {
+	names := make([]string, len(hostnames))
+	for idx, hostname := range hostnames {
+		names[idx] = mydyns.UnicodeHostname(hostname)
+	}
+	return strings.Join(names, ",")
+}
+
+// requestAddress returns the address of the client which sent r.
+func requestAddress(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip.IsLoopback() || isPrivateNetwork(ip) {
+		// Running through a proxy? Invalid headers are ignored.
+		if realip := net.ParseIP(r.Header.Get("X-Real-IP")); realip != nil {
+			ip = realip
+		}
+	}
+	return ip
+}
+
+// hostsStatus returns the status of all hosts of the token or if no token is
+// given, of all hosts of the authenticated user.
+func hostsStatus(r *http.Request, token, username, password string, basic bool) ([]*hostStatus, error) {
+	if err := checkLimit("ip", requestAddress(r).String()); err != nil {
+		return nil, err
+	}
+	if err := checkLocked(requestAddress(r), ""); err != nil {
+		return nil, err
+	}
+	var user string
+	var hostnames []string
+	switch {
+	case token != "":
+		var data mydyns.TokenData
+		if err := secret.Decode(mydyns.TokenName, token, &data); err != nil {
+			tokenFailed(requestAddress(r), "", "invalid token")
+			return nil, newServiceError(http.StatusForbidden, "invalid_token", "invalid token: %s", err)
+		}
+		dblock.RLock()
+		err := checkUser(requestAddress(r), data.User, data.Hostnames())
+		ok := security.Check(data.Security, data.User)
+		dblock.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			tokenFailed(requestAddress(r), data.User, "invalid security code", data.Hostnames()...)
+			return nil, newServiceError(http.StatusForbidden, "invalid_security_code", "invalid security code")
+		}
+		user, hostnames = data.User, data.Hostnames()
+	case basic:
+		if err := checkPassword(requestAddress(r), username, password); err != nil {
+			return nil, err
+		}
+		user = username
+	default:
+		return nil, newServiceError(http.StatusUnauthorized, "auth_required", "token or basic auth required")
+	}
+
+	dblock.RLock()
+	if hostnames == nil {
+		hostnames = hosts.Hosts()
+	}
+	var allowed []string
+	for _, hostname := range hostnames {
+		if hosts.CheckUser(hostname, user) {
+			allowed = append(allowed, hostname)
+		}
+	}
+	dblock.RUnlock()
+	if len(allowed) == 0 && token != "" {
+		return nil, newServiceError(http.StatusForbidden, "access_denied", "access denied")
+	}
+
+	result := make([]*hostStatus, 0, len(allowed))
+	for _, hostname := range allowed {
+		result = append(result, records.status(hostname))
+	}
+	return result, nil
+}
+
+// authFailed records a failed authentication or authorization in the audit
+// log, with one event for each of the given hosts.
+func authFailed(client net.IP, user, detail string, hostnames ...string) {
+	if len(hostnames) == 0 {
+		hostnames = []string{""}
+	}
+	for _, host := range hostnames {
+		event := &auditEvent{
+			Action: auditAuthFailed,
+			User:   user,
+			Host:   host,
+			Detail: detail,
+		}
+		if client != nil {
+			event.Client = client.String()
+		}
+		audit.record(event)
+	}
+}
+
+// tokenFailed records a failed authentication with a token. Failures are
+// counted for the client address, as tokens do not name a trustworthy user.
+func tokenFailed(client net.IP, user, detail string, hostnames ...string) {
+	limits.failed(client.String(), "")
+	authFailed(client, user, detail, hostnames...)
+}
+
+// checkUser checks that user exists and is not disabled. The caller must hold
+// dblock.
+func checkUser(client net.IP, user string, hostnames []string) error {
+	if !users.Exists(user) || users.Disabled(user) {
+		authFailed(client, user, "user disabled or deleted", hostnames...)
+		return newServiceError(http.StatusForbidden, "access_denied", "access denied")
+	}
+	return nil
+}
+
+// checkLimit takes a request from the rate limits of kind for keys.
+func checkLimit(kind string, keys ...string) error {
+	if ok, retry := limits.allow(kind, keys...); !ok {
+		return &serviceError{http.StatusTooManyRequests, "rate_limited", "too many requests", retry}
+	}
+	return nil
+}
+
+// checkPassword authenticates user, unless the user is locked out after
+// repeated failures.
+func checkPassword(client net.IP, username, password string) error {
+	if err := checkLocked(client, username); err != nil {
+		return err
+	}
+
+	// Read lock so we hold, when we are currently reloading things.
+	dblock.RLock()
+	ok := users.CheckPassword(username, password)
+	exists := users.Exists(username)
+	dblock.RUnlock()
+	if !ok {
+		// Failures for unknown users only count for the client address.
+		user := username
+		if !exists {
+			user = ""
+		}
+		limits.failed(client.String(), user)
+		authFailed(client, username, "invalid password")
+		return newServiceError(http.StatusForbidden, "authentication_failed", "authentication failed")
+	}
+	limits.succeeded(client.String(), username)
+	return nil
+}
+
+// checkLocked returns an error if user or the client address is locked out
+// after repeated failed authentications.
+func checkLocked(client net.IP, user string) error {
+	if locked, retry := limits.locked(client.String(), user); locked {
+		return &serviceError{http.StatusTooManyRequests, "locked_out", "too many failed authentications", retry}
+	}
+	return nil
+}
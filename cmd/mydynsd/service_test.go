@@ -0,0 +1,303 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/longsleep/mydyns"
+)
+
+const (
+	testUsers    = "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"
+	testHosts    = "home:alice\noffice:bob\n"
+	testSecurity = "alice:alicecode\nbob:bobcode\n"
+)
+
+// setupTestService loads test databases and sets up the globals needed to
+// create tokens and check updates.
+func setupTestService(t *testing.T) *DatabaseFiles {
+	files := testDatabaseFiles(t, testUsers, testHosts, testSecurity)
+	fn := filepath.Join(filepath.Dir(files.Users), "secret")
+	if err := ioutil.WriteFile(fn, []byte("0123456789abcdef0123456789abcdef"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if secret, err = mydyns.NewSecretFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	if limits, err = NewLimits(&LimitsConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	audit = NewAuditLog("", 0)
+	dnszone = "example.com"
+	allowPrivate = true
+	return files
+}
+
+func testRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/update", nil)
+	r.RemoteAddr = "203.0.113.1:1234"
+	return r
+}
+
+func serviceErrorStatus(err error) int {
+	var se *serviceError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	return 0
+}
+
+func TestTokensOfDisabledAndDeletedUsers(t *testing.T) {
+	tests := []struct {
+		name  string
+		users string
+	}{
+		{"disabled", "alice:!{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"},
+		{"deleted", "bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"},
+	}
+	for _, test := range tests {
+		files := setupTestService(t)
+		token, _, err := createToken(testRequest(), "alice", "secret", "home")
+		if err != nil {
+			t.Fatalf("%s: failed to create token: %v", test.name, err)
+		}
+		if _, err = updateHosts(testRequest(), token, "auto", true); err != nil {
+			t.Fatalf("%s: token rejected before change: %v", test.name, err)
+		}
+
+		if err = ioutil.WriteFile(files.Users, []byte(test.users), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = loadDatabases(files); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = updateHosts(testRequest(), token, "auto", true); serviceErrorStatus(err) != http.StatusForbidden {
+			t.Errorf("%s: expected update to be forbidden, got %v", test.name, err)
+		}
+		if _, err = hostsStatus(testRequest(), token, "", "", false); serviceErrorStatus(err) != http.StatusForbidden {
+			t.Errorf("%s: expected status to be forbidden, got %v", test.name, err)
+		}
+		if _, _, err = createToken(testRequest(), "alice", "secret", "home"); serviceErrorStatus(err) != http.StatusForbidden {
+			t.Errorf("%s: expected token creation to be forbidden, got %v", test.name, err)
+		}
+	}
+}
+
+func TestRequestAddress(t *testing.T) {
+	tests := []struct {
+		remote, realip, expected string
+	}{
+		{"203.0.113.1:1234", "", "203.0.113.1"},
+		{"203.0.113.1:1234", "198.51.100.1", "203.0.113.1"},
+		{"127.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:1234", "2001:db8::1", "2001:db8::1"},
+		{"127.0.0.1:1234", "", "127.0.0.1"},
+		{"127.0.0.1:1234", "garbage", "127.0.0.1"},
+		{"[::1]:1234", "not an ip", "::1"},
+	}
+	for _, test := range tests {
+		r := testRequest()
+		r.RemoteAddr = test.remote
+		if test.realip != "" {
+			r.Header.Set("X-Real-IP", test.realip)
+		}
+		ip := requestAddress(r)
+		if ip == nil || ip.String() != test.expected {
+			t.Errorf("%s %s: got %s, want %s", test.remote, test.realip, ip, test.expected)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	setupTestService(t)
+	var err error
+	if limits, err = NewLimits(&LimitsConfig{Failures: 3, Lockout: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failures of unknown users are only counted per client address.
+	for idx, name := range []string{"x1", "x2", "x3"} {
+		if _, _, err = createToken(testRequest(), name, "secret", "home"); serviceErrorStatus(err) != http.StatusForbidden {
+			t.Fatalf("failure %d: unexpected result %v", idx+1, err)
+		}
+	}
+	if len(limits.state.Failures) != 1 {
+		t.Errorf("expected failures of one client address, got %d", len(limits.state.Failures))
+	}
+	if _, _, err = createToken(testRequest(), "alice", "secret", "home"); serviceErrorStatus(err) != http.StatusTooManyRequests {
+		t.Errorf("client address should be locked out, got %v", err)
+	}
+
+	// Failures of a known user lock out that user from that address only.
+	other := func() *http.Request {
+		r := testRequest()
+		r.RemoteAddr = "203.0.113.9:1234"
+		return r
+	}
+	for i := 0; i < 3; i++ {
+		createToken(other(), "alice", "wrong", "home")
+	}
+	if _, _, err = createToken(other(), "alice", "secret", "home"); serviceErrorStatus(err) != http.StatusTooManyRequests {
+		t.Errorf("alice should be locked out, got %v", err)
+	}
+	if _, _, err = createToken(other(), "bob", "secret", "office"); err != nil {
+		t.Errorf("bob should not be locked out: %v", err)
+	}
+
+	// Invalid tokens count for the client address.
+	invalid := func() *http.Request {
+		r := testRequest()
+		r.RemoteAddr = "203.0.113.10:1234"
+		return r
+	}
+	for i := 0; i < 3; i++ {
+		updateHosts(invalid(), "invalid", "auto", true)
+	}
+	if _, err = updateHosts(invalid(), "invalid", "auto", true); serviceErrorStatus(err) != http.StatusTooManyRequests {
+		t.Errorf("client address should be locked out after invalid tokens, got %v", err)
+	}
+}
+
+func TestParseHostnames(t *testing.T) {
+	dnszone = "example.com"
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"myhost", "myhost"},
+		{"MyHost", "myhost"},
+		{"myhost.example.com", "myhost"},
+		{"myhost.example.com.", "myhost"},
+		{"mail.myhost", "mail.myhost"},
+		{"mail.myhost.example.com.", "mail.myhost"},
+		{"müller", "xn--mller-kva"},
+		{"müller.example.com.", "xn--mller-kva"},
+		{"myhost,müller", "myhost,xn--mller-kva"},
+		{"myhost.example.org", "myhost.example.org"},
+		{"", ""},
+		{"myhost,", ""},
+		{"myhost,MYHOST", ""},
+		{"müller,xn--mller-kva", ""},
+		{"my_host", ""},
+		{"myhost.example.org.", ""},
+		{"example.com.", ""},
+		{"*.myhost", ""},
+		{strings.Repeat("a.", 120) + "a", strings.Repeat("a.", 120) + "a"},
+		{strings.Repeat("a.", 121) + "a", ""},
+	}
+	for _, test := range tests {
+		hostnames, err := parseHostnames(test.value)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.value, hostnames)
+			}
+			continue
+		}
+		if err != nil || strings.Join(hostnames, ",") != test.expected {
+			t.Errorf("%q: got %v %v, want %s", test.value, hostnames, err, test.expected)
+		}
+	}
+}
+
+func TestUpdateSeveralHosts(t *testing.T) {
+	files := setupTestService(t)
+	hostsContent := "home:alice\ncottage:alice\nlan:alice:via=home,iid=::1:2:3:4\noffice:bob\n"
+	if err := ioutil.WriteFile(files.Hosts, []byte(hostsContent), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDatabases(files); err != nil {
+		t.Fatal(err)
+	}
+	update = NewNsUpdate(&testBackend{}, testRecordStore(t), NewAuditLog("", 0))
+	t.Cleanup(func() { update = nil })
+
+	token, hostnames, err := createToken(testRequest(), "alice", "secret", "home,cottage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(hostnames, ",") != "home,cottage" {
+		t.Errorf("unexpected token hosts %v", hostnames)
+	}
+	if _, _, err = createToken(testRequest(), "alice", "secret", "home,office"); serviceErrorStatus(err) != http.StatusForbidden {
+		t.Errorf("expected token for host of other user to be forbidden, got %v", err)
+	}
+
+	// Hosts which the user can no longer access are skipped.
+	if err = ioutil.WriteFile(files.Hosts, []byte("home:alice\ncottage:bob\nlan:alice:via=home,iid=::1:2:3:4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = loadDatabases(files); err != nil {
+		t.Fatal(err)
+	}
+	result, err := updateHosts(testRequest(), token, "2001:db8:1:2::5", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, host := range result.Hosts {
+		statuses = append(statuses, host.Name+" "+host.Status)
+	}
+	if strings.Join(statuses, ",") != "home accepted,cottage access_denied" {
+		t.Errorf("unexpected host results %v", statuses)
+	}
+
+	// The delegated host is updated in the same batch.
+	batch := <-update.queue
+	var queued []string
+	for _, data := range batch {
+		queued = append(queued, data.hostname+" "+data.ip.String())
+	}
+	if strings.Join(queued, ",") != "home 2001:db8:1:2::5,lan 2001:db8:1:2:1:2:3:4" {
+		t.Errorf("unexpected batch %v", queued)
+	}
+}
+
+func TestUpdateNormalizesTokenHosts(t *testing.T) {
+	setupTestService(t)
+	update = NewNsUpdate(&testBackend{}, testRecordStore(t), NewAuditLog("", 0))
+	t.Cleanup(func() { update = nil })
+
+	// Tokens may carry names as they were requested before names were
+	// normalized.
+	token, err := secret.Encode(mydyns.TokenName, mydyns.NewTokenData([]string{"HOME"}, "alice", security.Secret("alice")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := updateHosts(testRequest(), token, "203.0.113.5", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Hosts) != 1 || result.Hosts[0].Name != "home" {
+		t.Errorf("unexpected host results %+v", result.Hosts)
+	}
+	if batch := <-update.queue; len(batch) != 1 || batch[0].hostname != "home" {
+		t.Errorf("unexpected batch %+v", batch)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// FileWatcher watches a set of files and triggers a callback when any of
+// them changes. Changes are debounced, so a burst of changes results in a
+// single trigger.
+type FileWatcher struct {
+	files    map[string]bool
+	delay    time.Duration
+	interval time.Duration
+	trigger  func()
+	changed  chan bool
+}
+
+func NewFileWatcher(files []string, delay, interval time.Duration, trigger func()) (*FileWatcher, error) {
+	fw := &FileWatcher{
+		files:    make(map[string]bool),
+		delay:    delay,
+		interval: interval,
+		trigger:  trigger,
+		changed:  make(chan bool, 1),
+	}
+	for _, fn := range files {
+		abs, err := filepath.Abs(fn)
+		if err != nil {
+			return nil, err
+		}
+		fw.files[abs] = true
+	}
+	return fw, nil
+}
+
+// run starts watching. It uses file system notifications when available and
+// falls back to polling otherwise.
+func (fw *FileWatcher) run() {
+	go fw.debounce()
+
+	watcher, err := fw.notifier()
+	if err != nil {
+		log.Printf("File notifications not available, polling every %s: %v\n", fw.interval, err)
+		fw.poll()
+		return
+	}
+	defer watcher.Close()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if fw.files[filepath.Clean(event.Name)] {
+				fw.notify()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("File watcher error", err)
+		}
+	}
+}
+
+// notifier creates a file system watcher for the directories of all watched
+// files. Directories are watched, to also see files which get replaced by
+// renaming, as many editors and configuration management tools do.
+func (fw *FileWatcher) notifier() (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]bool)
+	for fn := range fw.files {
+		dir := filepath.Dir(fn)
+		if dirs[dir] {
+			continue
+		}
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+		dirs[dir] = true
+	}
+	return watcher, nil
+}
+
+// poll checks the watched files for changes of their modification time, size
+// or identity in regular intervals.
+func (fw *FileWatcher) poll() {
+	stats := make(map[string]os.FileInfo)
+	for fn := range fw.files {
+		stats[fn], _ = os.Stat(fn)
+	}
+	c := time.Tick(fw.interval)
+	for range c {
+		for fn := range fw.files {
+			current, _ := os.Stat(fn)
+			previous := stats[fn]
+			stats[fn] = current
+			switch {
+			case current == nil && previous == nil:
+			case current == nil || previous == nil:
+				fw.notify()
+			case !os.SameFile(current, previous) ||
+				!current.ModTime().Equal(previous.ModTime()) ||
+				current.Size() != previous.Size():
+				fw.notify()
+			}
+		}
+	}
+}
+
+func (fw *FileWatcher) notify() {
+	// Send non blocking, a pending change is enough.
+	select {
+	case fw.changed <- true:
+	default:
+	}
+}
+
+// debounce waits until no further changes happened for the configured delay
+// before triggering.
+func (fw *FileWatcher) debounce() {
+	for {
+		<-fw.changed
+		timer := time.NewTimer(fw.delay)
+	Wait:
+		for {
+			select {
+			case <-fw.changed:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(fw.delay)
+			case <-timer.C:
+				break Wait
+			}
+		}
+		fw.trigger()
+	}
+}
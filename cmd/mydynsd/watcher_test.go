@@ -0,0 +1,97 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileWatcherDebounce(t *testing.T) {
+	var triggered int32
+	fw, err := NewFileWatcher(nil, 50*time.Millisecond, time.Second, func() {
+		atomic.AddInt32(&triggered, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fw.debounce()
+
+	for i := 0; i < 5; i++ {
+		fw.notify()
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&triggered); n != 1 {
+		t.Errorf("triggered %d times for a burst of changes, want 1", n)
+	}
+
+	fw.notify()
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&triggered); n != 2 {
+		t.Errorf("triggered %d times, want 2", n)
+	}
+}
+
+func TestFileWatcherRun(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "hosts.db")
+	if err := ioutil.WriteFile(fn, []byte("home:alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	triggered := make(chan bool, 10)
+	fw, err := NewFileWatcher([]string{fn}, 10*time.Millisecond, 10*time.Millisecond, func() {
+		triggered <- true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fw.run()
+	// Give the watcher time to start.
+	time.Sleep(100 * time.Millisecond)
+
+	// Other files in the directory are ignored.
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-triggered:
+		t.Error("triggered for other file")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Files which are replaced by renaming are seen.
+	if err := ioutil.WriteFile(fn+".tmp", []byte("home:alice\noffice:bob\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(fn+".tmp", fn); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-triggered:
+	case <-time.After(5 * time.Second):
+		t.Error("not triggered for replaced file")
+	}
+}
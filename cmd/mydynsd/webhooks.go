@@ -0,0 +1,193 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webhookSignatureHeader is the header with the HMAC-SHA256 signature of the
+// payload, if the webhook has a secret.
+const webhookSignatureHeader = "X-Mydyns-Signature"
+
+// WebhookConfig defines a webhook in the webhooks section of the
+// configuration file.
+type WebhookConfig struct {
+	URL     string   `yaml:"url"`
+	Secret  string   `yaml:"secret"`
+	Hosts   []string `yaml:"hosts"`
+	Timeout string   `yaml:"timeout"`
+	Retries *int     `yaml:"retries"`
+}
+
+// Webhook posts address changes as JSON to an URL. Deliveries are sent in
+// order and retried with increasing delay.
+type Webhook struct {
+	url     string
+	secret  []byte
+	hosts   map[string]bool
+	retries int
+	client  *http.Client
+	queue   chan *addressChange
+}
+
+func NewWebhook(config *WebhookConfig) (*Webhook, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %s: %w", config.URL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("webhook %s: http or https URL required", config.URL)
+	}
+	timeout := 10 * time.Second
+	if config.Timeout != "" {
+		if timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return nil, fmt.Errorf("webhook %s: invalid timeout: %w", config.URL, err)
+		}
+	}
+	retries := 5
+	if config.Retries != nil {
+		if retries = *config.Retries; retries < 0 {
+			return nil, fmt.Errorf("webhook %s: invalid retries %d", config.URL, retries)
+		}
+	}
+
+	hook := &Webhook{
+		url:     config.URL,
+		secret:  []byte(config.Secret),
+		retries: retries,
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan *addressChange, 100),
+	}
+	if len(config.Hosts) > 0 {
+		hook.hosts = make(map[string]bool)
+		for _, host := range config.Hosts {
+			// Changes use the normalized names relative to the zone.
+			name, err := relativeHostname(host)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: host %s: %w", config.URL, host, err)
+			}
+			hook.hosts[name] = true
+		}
+	}
+	return hook, nil
+}
+
+// changed queues change for delivery, if the webhook is subscribed to the
+// host.
+func (hook *Webhook) changed(change *addressChange) {
+	if hook.hosts != nil && !hook.hosts[change.Host] {
+		return
+	}
+	select {
+	case hook.queue <- change:
+	default:
+		log.Println("Webhook queue full, dropping change", hook.url, change.Host, change.New)
+	}
+}
+
+func (hook *Webhook) run() {
+	for change := range hook.queue {
+		payload, err := json.Marshal(change)
+		if err != nil {
+			log.Println("Webhook payload failed", err)
+			continue
+		}
+		delay := time.Second
+		for attempt := 0; ; attempt++ {
+			if err = hook.deliver(payload); err == nil {
+				break
+			}
+			if attempt >= hook.retries {
+				log.Println("Webhook failed, giving up", hook.url, change.Host, err)
+				break
+			}
+			log.Printf("Webhook failed, retrying in %s: %s %s %v\n", delay, hook.url, change.Host, err)
+			time.Sleep(delay)
+			if delay < 5*time.Minute {
+				delay *= 2
+			}
+		}
+	}
+}
+
+// deliver posts payload once.
+func (hook *Webhook) deliver(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mydynsd/"+version)
+	if len(hook.secret) > 0 {
+		mac := hmac.New(sha256.New, hook.secret)
+		mac.Write(payload)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	response, err := hook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 4096))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("server returned %s", response.Status)
+	}
+	return nil
+}
+
+// Webhooks is the set of all configured webhooks.
+type Webhooks []*Webhook
+
+func NewWebhooks(configs []*WebhookConfig) (Webhooks, error) {
+	var hooks Webhooks
+	for _, config := range configs {
+		hook, err := NewWebhook(config)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// changed queues change for all subscribed webhooks.
+func (hooks Webhooks) changed(change *addressChange) {
+	for _, hook := range hooks {
+		hook.changed(change)
+	}
+}
+
+func (hooks Webhooks) run() {
+	for _, hook := range hooks {
+		go hook.run()
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewWebhook(t *testing.T) {
+	dnszone = "dyn.example.com"
+	two, zero, negative := 2, 0, -1
+	tests := []struct {
+		name    string
+		config  *WebhookConfig
+		retries int
+		err     bool
+	}{
+		{"defaults", &WebhookConfig{URL: "https://hooks.example.com/mydyns"}, 5, false},
+		{"retries", &WebhookConfig{URL: "http://hooks.example.com", Retries: &two, Timeout: "5s"}, 2, false},
+		{"no retries", &WebhookConfig{URL: "http://hooks.example.com", Retries: &zero}, 0, false},
+		{"negative retries", &WebhookConfig{URL: "http://hooks.example.com", Retries: &negative}, 0, true},
+		{"invalid host", &WebhookConfig{URL: "http://hooks.example.com", Hosts: []string{"my_host"}}, 0, true},
+		{"host not in zone", &WebhookConfig{URL: "http://hooks.example.com", Hosts: []string{"home.example.org."}}, 0, true},
+		{"no URL", &WebhookConfig{}, 0, true},
+		{"no scheme", &WebhookConfig{URL: "hooks.example.com/mydyns"}, 0, true},
+		{"unsupported scheme", &WebhookConfig{URL: "ftp://hooks.example.com"}, 0, true},
+		{"invalid URL", &WebhookConfig{URL: "http://%zz"}, 0, true},
+		{"invalid timeout", &WebhookConfig{URL: "http://hooks.example.com", Timeout: "soon"}, 0, true},
+	}
+	for _, test := range tests {
+		hook, err := NewWebhook(test.config)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if hook.retries != test.retries {
+			t.Errorf("%s: got %d retries, want %d", test.name, hook.retries, test.retries)
+		}
+	}
+}
+
+func TestWebhookHosts(t *testing.T) {
+	dnszone = "dyn.example.com"
+	hook, err := NewWebhook(&WebhookConfig{URL: "http://hooks.example.com", Hosts: []string{"HOME", "München.dyn.example.com."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"office", "home", "xn--mnchen-3ya"} {
+		hook.changed(&addressChange{Host: host, Family: "ipv4", New: net.ParseIP("203.0.113.5")})
+	}
+	if len(hook.queue) != 2 {
+		t.Fatalf("expected 2 queued changes, got %d", len(hook.queue))
+	}
+	for _, expected := range []string{"home", "xn--mnchen-3ya"} {
+		if change := <-hook.queue; change.Host != expected {
+			t.Errorf("unexpected change of %s, want %s", change.Host, expected)
+		}
+	}
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	var request *http.Request
+	var body []byte
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		secret    string
+		status    int
+		signature bool
+		err       bool
+	}{
+		{"signed", "shared secret", http.StatusOK, true, false},
+		{"unsigned", "", http.StatusNoContent, false, false},
+		{"server error", "shared secret", http.StatusInternalServerError, true, true},
+		{"not found", "", http.StatusNotFound, false, true},
+	}
+	payload := []byte(`{"host":"home","family":"ipv4","new":"203.0.113.5","time":"2020-01-01T00:00:00Z"}`)
+	for _, test := range tests {
+		hook, err := NewWebhook(&WebhookConfig{URL: server.URL, Secret: test.secret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		status = test.status
+		err = hook.deliver(payload)
+		if test.err && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		} else if !test.err && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: unexpected request %s %s", test.name, request.Method, request.Header.Get("Content-Type"))
+		}
+		if string(body) != string(payload) {
+			t.Errorf("%s: unexpected payload %s", test.name, body)
+		}
+		expected := ""
+		if test.signature {
+			mac := hmac.New(sha256.New, []byte(test.secret))
+			mac.Write(payload)
+			expected = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		}
+		if signature := request.Header.Get(webhookSignatureHeader); signature != expected {
+			t.Errorf("%s: got signature %q, want %q", test.name, signature, expected)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SOAConfig defines the SOA and NS records of the zone for the backends
+// which publish the whole zone.
+type SOAConfig struct {
+	Nameservers []string `yaml:"nameservers"`
+	Hostmaster  string   `yaml:"hostmaster"`
+	Refresh     string   `yaml:"refresh"`
+	Retry       string   `yaml:"retry"`
+	Expire      string   `yaml:"expire"`
+	Minimum     string   `yaml:"minimum"`
+}
+
+// records returns the SOA record with serial 0 and the NS records of the
+// zone origin. The hostmaster defaults to hostmaster in the zone, the
+// minimum to ttl.
+func (config *SOAConfig) records(origin string, ttl uint32) (*dns.SOA, []dns.RR, error) {
+	if len(config.Nameservers) == 0 {
+		return nil, nil, errors.New("nameservers required")
+	}
+	hostmaster := config.Hostmaster
+	if hostmaster == "" {
+		hostmaster = "hostmaster." + origin
+	}
+	soa := &dns.SOA{
+		Hdr:  dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:   dns.Fqdn(strings.ToLower(config.Nameservers[0])),
+		Mbox: dns.Fqdn(strings.Replace(strings.ToLower(hostmaster), "@", ".", 1)),
+	}
+	timers := []struct {
+		value        string
+		defaultValue time.Duration
+		dst          *uint32
+	}{
+		{config.Refresh, time.Hour, &soa.Refresh},
+		{config.Retry, 15 * time.Minute, &soa.Retry},
+		{config.Expire, 7 * 24 * time.Hour, &soa.Expire},
+		{config.Minimum, time.Duration(ttl) * time.Second, &soa.Minttl},
+	}
+	for _, timer := range timers {
+		d := timer.defaultValue
+		if timer.value != "" {
+			var err error
+			if d, err = time.ParseDuration(timer.value); err != nil {
+				return nil, nil, fmt.Errorf("invalid soa timer: %w", err)
+			}
+		}
+		*timer.dst = uint32(d / time.Second)
+	}
+
+	var ns []dns.RR
+	for _, name := range config.Nameservers {
+		ns = append(ns, &dns.NS{
+			Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  dns.Fqdn(strings.ToLower(name)),
+		})
+	}
+	return soa, ns, nil
+}
+
+// serialAfter returns whether serial a is after b in serial number
+// arithmetic as defined in RFC 1982.
+func serialAfter(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// addressRecord returns the A or AAAA record of name for ip.
+func addressRecord(name string, ip net.IP, ttl uint32) dns.RR {
+	header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+	if ip4 := ip.To4(); ip4 != nil {
+		header.Rrtype = dns.TypeA
+		return &dns.A{Hdr: header, A: ip4}
+	}
+	header.Rrtype = dns.TypeAAAA
+	return &dns.AAAA{Hdr: header, AAAA: ip}
+}
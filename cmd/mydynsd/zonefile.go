@@ -0,0 +1,205 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneFileConfig defines the zone file backend in the zonefile section of
+// the configuration file.
+type ZoneFileConfig struct {
+	SOAConfig `yaml:",inline"`
+	File      string   `yaml:"file"`
+	Base      string   `yaml:"base"`
+	Reload    []string `yaml:"reload"`
+}
+
+// ZoneFile renders the records of all hosts into a zone file, together with
+// the records of a base zone file. Every change increments the serial of the
+// zone and runs the reload command.
+type ZoneFile struct {
+	origin  string
+	ttl     uint32
+	soa     *dns.SOA
+	ns      []dns.RR
+	base    string
+	records *RecordStore
+	generatedFile
+}
+
+func NewZoneFile(config *ZoneFileConfig, zone string, ttl int, records *RecordStore) (*ZoneFile, error) {
+	if config == nil {
+		return nil, errors.New("zonefile section required")
+	}
+	if config.File == "" {
+		return nil, errors.New("file required")
+	}
+	if err := requireState(records); err != nil {
+		return nil, err
+	}
+	zf := &ZoneFile{
+		origin:  dns.Fqdn(zone),
+		ttl:     uint32(ttl),
+		base:    config.Base,
+		records: records,
+		generatedFile: generatedFile{
+			file:   config.File,
+			reload: config.Reload,
+		},
+	}
+	var err error
+	if zf.soa, zf.ns, err = config.records(zf.origin, zf.ttl); err != nil {
+		return nil, err
+	}
+	if _, err = zf.readBase(); err != nil {
+		return nil, err
+	}
+
+	// Continue with the serial of the existing zone file, so it increases
+	// across restarts.
+	zf.soa.Serial = uint32(time.Now().Unix())
+	if f, err := os.Open(zf.file); err == nil {
+		parser := dns.NewZoneParser(f, zf.origin, zf.file)
+		for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if serialAfter(soa.Serial, zf.soa.Serial) {
+					zf.soa.Serial = soa.Serial
+				}
+				break
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return zf, nil
+}
+
+// readBase reads and checks the base zone file. Its records must be in the
+// zone and it cannot have a SOA record.
+func (zf *ZoneFile) readBase() ([]byte, error) {
+	if zf.base == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(zf.base)
+	if err != nil {
+		return nil, err
+	}
+	parser := dns.NewZoneParser(bytes.NewReader(data), zf.origin, zf.base)
+	parser.SetDefaultTTL(zf.ttl)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return nil, fmt.Errorf("%s: SOA record not allowed", zf.base)
+		}
+		if !dns.IsSubDomain(zf.origin, rr.Header().Name) {
+			return nil, fmt.Errorf("%s: record not in zone: %s", zf.base, rr)
+		}
+	}
+	if err = parser.Err(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// process implements Backend. It writes the zone file with the records of
+// all hosts including work, and runs the reload command if anything changed.
+func (zf *ZoneFile) process(ctx context.Context, work map[string]*nsUpdateData) error {
+	addresses := currentAddresses(zf.records, work)
+	wildcards := make(map[string]bool)
+	for _, data := range work {
+		wildcards[data.hostname] = data.wildcard
+	}
+	dblock.RLock()
+	for hostname := range addresses {
+		if _, ok := wildcards[hostname]; !ok {
+			wildcards[hostname] = hosts.Options(hostname).Wildcard
+		}
+	}
+	dblock.RUnlock()
+
+	base, err := zf.readBase()
+	if err != nil {
+		return err
+	}
+
+	// Everything but the SOA record, to find out if anything changed.
+	var content bytes.Buffer
+	for _, rr := range zf.ns {
+		fmt.Fprintln(&content, rr)
+	}
+	if base != nil {
+		fmt.Fprintf(&content, "\n; Base zone %s\n", zf.base)
+		content.Write(base)
+		fmt.Fprintf(&content, "\n$ORIGIN %s\n$TTL %d\n", zf.origin, zf.ttl)
+	}
+	fmt.Fprintf(&content, "\n; Hosts\n")
+	for _, rr := range zf.hostRecords(addresses, wildcards) {
+		fmt.Fprintln(&content, rr)
+	}
+	if zf.unchanged(content.Bytes()) {
+		return nil
+	}
+
+	soa := dns.Copy(zf.soa).(*dns.SOA)
+	soa.Serial++
+	var data bytes.Buffer
+	fmt.Fprintf(&data, "; Zone %s generated by mydynsd, do not edit.\n", zf.origin)
+	fmt.Fprintf(&data, "$ORIGIN %s\n$TTL %d\n", zf.origin, zf.ttl)
+	fmt.Fprintln(&data, soa)
+	data.Write(content.Bytes())
+	return zf.publish(ctx, content.Bytes(), data.Bytes(), func() error {
+		// The serial is used up once the file was written.
+		zf.soa = soa
+		log.Printf("Wrote zone file %s with serial %d\n", zf.file, soa.Serial)
+		return nil
+	})
+}
+
+// hostRecords returns the address records of all hosts sorted by name.
+func (zf *ZoneFile) hostRecords(addresses map[string][]net.IP, wildcards map[string]bool) []dns.RR {
+	var rrs []dns.RR
+	for _, hostname := range validHostnames(addresses) {
+		names := []string{hostname + "." + zf.origin}
+		if wildcards[hostname] {
+			names = append(names, "*."+hostname+"."+zf.origin)
+		}
+		for _, name := range names {
+			for _, t := range []string{"A", "AAAA"} {
+				for _, ip := range addresses[hostname] {
+					if recordType(ip) == t {
+						rrs = append(rrs, addressRecord(name, ip, zf.ttl))
+					}
+				}
+			}
+		}
+	}
+	return rrs
+}
@@ -0,0 +1,187 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSOAConfigRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   SOAConfig
+		expected string
+		ns       int
+		err      bool
+	}{
+		{"defaults", SOAConfig{Nameservers: []string{"NS1.example.com", "ns2.example.com."}},
+			"dyn.example.com.\t60\tIN\tSOA\tns1.example.com. hostmaster.dyn.example.com. 0 3600 900 604800 60", 2, false},
+		{"hostmaster", SOAConfig{Nameservers: []string{"ns1.example.com"}, Hostmaster: "admin@example.com", Refresh: "2h", Minimum: "5m"},
+			"dyn.example.com.\t60\tIN\tSOA\tns1.example.com. admin.example.com. 0 7200 900 604800 300", 1, false},
+		{"no nameservers", SOAConfig{}, "", 0, true},
+		{"invalid timer", SOAConfig{Nameservers: []string{"ns1.example.com"}, Retry: "often"}, "", 0, true},
+	}
+	for _, test := range tests {
+		soa, ns, err := test.config.records("dyn.example.com.", 60)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if soa.String() != test.expected {
+			t.Errorf("%s: got %q, want %q", test.name, soa.String(), test.expected)
+		}
+		if len(ns) != test.ns {
+			t.Errorf("%s: got %d NS records, want %d", test.name, len(ns), test.ns)
+		}
+	}
+}
+
+func TestSerialAfter(t *testing.T) {
+	tests := []struct {
+		a, b     uint32
+		expected bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{1, 1, false},
+		{0, 0xffffffff, true},
+		{0xffffffff, 0, false},
+		{0x80000001, 1, false},
+	}
+	for _, test := range tests {
+		if result := serialAfter(test.a, test.b); result != test.expected {
+			t.Errorf("serialAfter(%d, %d) = %v, want %v", test.a, test.b, result, test.expected)
+		}
+	}
+}
+
+func newTestZoneFile(t *testing.T, records *RecordStore) *ZoneFile {
+	config := &ZoneFileConfig{
+		SOAConfig: SOAConfig{Nameservers: []string{"ns1.example.com"}},
+		File:      filepath.Join(filepath.Dir(records.file), "dyn.example.com.zone"),
+	}
+	zf, err := NewZoneFile(config, "dyn.example.com", 60, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zf
+}
+
+// testZoneRecords returns the records of the written zone file without the
+// SOA record.
+func testZoneRecords(t *testing.T, zf *ZoneFile) []string {
+	f, err := os.Open(zf.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var result []string
+	parser := dns.NewZoneParser(f, "", zf.file)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			result = append(result, strings.Replace(rr.String(), "\t", " ", -1))
+		}
+	}
+	if err := parser.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestZoneFileProcess(t *testing.T) {
+	files := testDatabaseFiles(t, testUsers, "home:alice:wildcard\noffice:bob\n", "")
+	records := testRecordStore(t, testUpdate("office", "203.0.113.6", false))
+	zf := newTestZoneFile(t, records)
+	serial := zf.soa.Serial
+
+	steps := []struct {
+		name     string
+		hosts    string
+		update   *nsUpdateData
+		expected []string
+	}{
+		{"wildcard", "", testUpdate("home", "203.0.113.5", true), []string{
+			"dyn.example.com. 60 IN NS ns1.example.com.",
+			"home.dyn.example.com. 60 IN A 203.0.113.5",
+			"*.home.dyn.example.com. 60 IN A 203.0.113.5",
+			"office.dyn.example.com. 60 IN A 203.0.113.6",
+		}},
+		{"second address", "", testUpdate("office", "2001:db8::1", false), []string{
+			"dyn.example.com. 60 IN NS ns1.example.com.",
+			"home.dyn.example.com. 60 IN A 203.0.113.5",
+			"*.home.dyn.example.com. 60 IN A 203.0.113.5",
+			"office.dyn.example.com. 60 IN A 203.0.113.6",
+			"office.dyn.example.com. 60 IN AAAA 2001:db8::1",
+		}},
+		{"host deleted", "home:alice\n", testUpdate("home", "203.0.113.7", false), []string{
+			"dyn.example.com. 60 IN NS ns1.example.com.",
+			"home.dyn.example.com. 60 IN A 203.0.113.7",
+		}},
+	}
+	for _, step := range steps {
+		if step.hosts != "" {
+			if err := ioutil.WriteFile(files.Hosts, []byte(step.hosts), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadDatabases(files); err != nil {
+				t.Fatal(err)
+			}
+		}
+		work := testWork(step.update)
+		if err := zf.process(context.Background(), work); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		records.applied(work)
+		result := testZoneRecords(t, zf)
+		if strings.Join(result, "\n") != strings.Join(step.expected, "\n") {
+			t.Errorf("%s: unexpected zone:\n%s", step.name, strings.Join(result, "\n"))
+		}
+		serial++
+		if zf.soa.Serial != serial {
+			t.Errorf("%s: serial %d, want %d", step.name, zf.soa.Serial, serial)
+		}
+	}
+
+	// Nothing changed, the file is not written again.
+	if err := zf.process(context.Background(), testWork(testUpdate("home", "203.0.113.7", false))); err != nil {
+		t.Fatal(err)
+	}
+	if zf.soa.Serial != serial {
+		t.Error("serial changed without changes")
+	}
+
+	// The serial continues after a restart.
+	if restarted := newTestZoneFile(t, records); restarted.soa.Serial != serial {
+		t.Errorf("serial %d after restart, want %d", restarted.soa.Serial, serial)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package mydyns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WriteFileAtomic writes data to a temporary file next to fn and renames it
+// to fn, so readers either see the old or the new content. The permissions
+// of an existing file are kept.
+func WriteFileAtomic(fn string, data []byte, perm os.FileMode) error {
+	if fi, err := os.Stat(fn); err == nil {
+		perm = fi.Mode().Perm()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// ValidEntryValue checks if s can be stored as a field in one of the colon
+// separated database files.
+func ValidEntryValue(s string) bool {
+	if s == "" || strings.HasPrefix(s, "#") || strings.TrimSpace(s) != s {
+		return false
+	}
+	return !strings.ContainsAny(s, ":,\"\r\n")
+}
@@ -4,6 +4,12 @@ go 1.13
 
 require (
 	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gorilla/securecookie v1.1.1
+	github.com/miekg/dns v1.1.50
+	golang.org/x/crypto v0.5.0
+	golang.org/x/net v0.5.0
+	golang.org/x/term v0.4.0
 	gopkg.in/alecthomas/kingpin.v1 v1.3.7
+	gopkg.in/yaml.v2 v2.2.2
 )
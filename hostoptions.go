@@ -0,0 +1,133 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package mydyns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HostOptions defines the optional settings of a host, stored after the
+// users in the hosts database as comma-separated list of key=value pairs and
+// flags.
+type HostOptions struct {
+	// Via is the host whose IPv6 prefix is used to compute the IPv6 address
+	// of this host, for hosts behind a router with a delegated prefix.
+	Via string
+	// InterfaceID is the static part of the IPv6 address of this host,
+	// which is combined with the prefix of the Via host.
+	InterfaceID net.IP
+	// PrefixLength is the number of bits taken from the Via host address.
+	PrefixLength int
+	// Wildcard maintains the wildcard records of the host together with its
+	// own records, so all names below the host resolve to its address.
+	Wildcard bool
+}
+
+// DefaultPrefixLength is the prefix length used for delegated hosts, when
+// not set.
+const DefaultPrefixLength = 64
+
+// ParseHostOptions parses the options field of a hosts database entry.
+func ParseHostOptions(s string) (*HostOptions, error) {
+	options := &HostOptions{}
+	if strings.TrimSpace(s) == "" {
+		return options, nil
+	}
+	for _, option := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(option), "=", 2)
+		key, value := parts[0], ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		switch key {
+		case "via":
+			via, err := NormalizeHostname(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid via host: %s", value)
+			}
+			options.Via = via
+		case "iid":
+			iid := net.ParseIP(value)
+			if iid == nil || iid.To4() != nil {
+				return nil, fmt.Errorf("invalid interface identifier: %s", value)
+			}
+			options.InterfaceID = iid
+		case "prefix":
+			length, err := strconv.Atoi(value)
+			if err != nil || length < 1 || length > 127 {
+				return nil, fmt.Errorf("invalid prefix length: %s", value)
+			}
+			options.PrefixLength = length
+		case "wildcard":
+			if len(parts) == 2 {
+				return nil, fmt.Errorf("wildcard takes no value")
+			}
+			options.Wildcard = true
+		default:
+			return nil, fmt.Errorf("unknown option: %s", key)
+		}
+	}
+	if (options.Via == "") != (options.InterfaceID == nil) {
+		return nil, fmt.Errorf("via and iid must be set together")
+	}
+	if options.PrefixLength != 0 && options.Via == "" {
+		return nil, fmt.Errorf("prefix requires via")
+	}
+	return options, nil
+}
+
+// String formats the options as stored in the hosts database.
+func (options *HostOptions) String() string {
+	var result []string
+	if options.Via != "" {
+		result = append(result, "via="+options.Via, "iid="+options.InterfaceID.String())
+	}
+	if options.PrefixLength != 0 {
+		result = append(result, "prefix="+strconv.Itoa(options.PrefixLength))
+	}
+	if options.Wildcard {
+		result = append(result, "wildcard")
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
+
+// DelegatedAddress computes the IPv6 address of the host from the address of
+// its Via host. It returns nil if the host is not delegated or prefix is no
+// IPv6 address.
+func (options *HostOptions) DelegatedAddress(prefix net.IP) net.IP {
+	if options.Via == "" || prefix.To4() != nil || len(prefix) != net.IPv6len {
+		return nil
+	}
+	length := options.PrefixLength
+	if length == 0 {
+		length = DefaultPrefixLength
+	}
+	mask := net.CIDRMask(length, 8*net.IPv6len)
+	ip := make(net.IP, net.IPv6len)
+	for idx := range ip {
+		ip[idx] = prefix[idx]&mask[idx] | options.InterfaceID[idx]&^mask[idx]
+	}
+	return ip
+}
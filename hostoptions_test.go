@@ -0,0 +1,96 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package mydyns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseHostOptions(t *testing.T) {
+	tests := []struct {
+		options  string
+		expected string
+		err      bool
+	}{
+		{"", "", false},
+		{" ", "", false},
+		{"wildcard", "wildcard", false},
+		{"via=router,iid=::1:2:3:4", "iid=::1:2:3:4,via=router", false},
+		{"via=Router, iid=::1:2:3:4, prefix=56, wildcard", "iid=::1:2:3:4,prefix=56,via=router,wildcard", false},
+		{"via=münchen,iid=::1", "iid=::1,via=xn--mnchen-3ya", false},
+		{"via=router", "", true},
+		{"iid=::1", "", true},
+		{"prefix=56", "", true},
+		{"via=router,iid=192.0.2.1", "", true},
+		{"via=router,iid=nonsense", "", true},
+		{"via=-router,iid=::1", "", true},
+		{"via=router,iid=::1,prefix=0", "", true},
+		{"via=router,iid=::1,prefix=128", "", true},
+		{"via=router,iid=::1,prefix=many", "", true},
+		{"wildcard=yes", "", true},
+		{"unknown", "", true},
+		{"wildcard,", "", true},
+	}
+	for _, test := range tests {
+		options, err := ParseHostOptions(test.options)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseHostOptions(%q): expected error", test.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseHostOptions(%q): unexpected error: %v", test.options, err)
+			continue
+		}
+		if result := options.String(); result != test.expected {
+			t.Errorf("ParseHostOptions(%q) = %q, want %q", test.options, result, test.expected)
+		}
+	}
+}
+
+func TestDelegatedAddress(t *testing.T) {
+	tests := []struct {
+		options  string
+		prefix   string
+		expected string
+	}{
+		{"via=router,iid=::1:2:3:4", "2001:db8:1:2:aaaa:bbbb:cccc:dddd", "2001:db8:1:2:1:2:3:4"},
+		{"via=router,iid=::1:2:3:4,prefix=56", "2001:db8:1:2:aaaa:bbbb:cccc:dddd", "2001:db8:1:0:1:2:3:4"},
+		{"via=router,iid=::ff:1:2:3:4,prefix=56", "2001:db8:1:200::1", "2001:db8:1:2ff:1:2:3:4"},
+		{"via=router,iid=::1", "203.0.113.1", ""},
+		{"wildcard", "2001:db8::1", ""},
+	}
+	for _, test := range tests {
+		options, err := ParseHostOptions(test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := options.DelegatedAddress(net.ParseIP(test.prefix))
+		if test.expected == "" {
+			if ip != nil {
+				t.Errorf("DelegatedAddress(%q) with %q = %s, want nil", test.prefix, test.options, ip)
+			}
+		} else if ip.String() != test.expected {
+			t.Errorf("DelegatedAddress(%q) with %q = %s, want %s", test.prefix, test.options, ip, test.expected)
+		}
+	}
+}
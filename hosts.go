@@ -0,0 +1,281 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package mydyns
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// MaxHostnameLength is the maximum length of a domain name in text form
+// without the trailing dot, as defined in RFC 1035.
+const MaxHostnameLength = 253
+
+// ValidHostname checks if host is a valid host name relative to the zone. It
+// can have multiple labels separated by dots, each being a valid label as
+// defined in RFC 1123.
+func ValidHostname(host string) bool {
+	if len(host) == 0 || len(host) > MaxHostnameLength {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if !validLabel(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// validLabel checks if label is a valid host name label as defined in
+// RFC 1123.
+func validLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 {
+		return false
+	}
+	for idx, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' && idx > 0 && idx < len(label)-1:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeHostname returns host in lower case, as DNS names are case
+// insensitive. Internationalized names are converted to punycode. It returns
+// an error if host is not valid.
+func NormalizeHostname(host string) (string, error) {
+	name, err := ASCIIHostname(host)
+	if err != nil || !ValidHostname(name) || !keepsPunycode(host, name) {
+		return "", fmt.Errorf("invalid hostname %s", host)
+	}
+	return name, nil
+}
+
+// keepsPunycode checks that punycode labels of host are unchanged in name.
+// Labels like xn--myhost- decode to plain ASCII and would otherwise turn
+// into a different name.
+func keepsPunycode(host, name string) bool {
+	labels := strings.FieldsFunc(strings.ToLower(host), func(c rune) bool {
+		// Label separators mapped to dots by IDNA.
+		return c == '.' || c == '。' || c == '．' || c == '｡'
+	})
+	converted := strings.Split(name, ".")
+	if len(labels) != len(converted) {
+		return false
+	}
+	for idx, label := range labels {
+		if strings.HasPrefix(label, "xn--") && label != converted[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+type HostsFile struct {
+	hosts   map[string][]string
+	options map[string]*HostOptions
+}
+
+func NewHostsFile(fn string) (*HostsFile, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseHosts(f)
+}
+
+// ParseHosts reads hosts database entries from r.
+func ParseHosts(r io.Reader) (*HostsFile, error) {
+	// hosts files are essentially csv files.
+	reader := csv.NewReader(r)
+	reader.Comma = ':'
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	entries, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &HostsFile{
+		hosts:   make(map[string][]string),
+		options: make(map[string]*HostOptions),
+	}
+	for idx, entry := range entries {
+		if len(entry) < 2 || entry[0] == "" || entry[1] == "" {
+			return nil, fmt.Errorf("invalid entry %d: host and users required", idx+1)
+		}
+		host, err := NormalizeHostname(entry[0])
+		if err != nil {
+			// Entries from before names were checked may not be valid
+			// anymore, skip them instead of refusing all hosts.
+			log.Printf("Skipping invalid host entry %d: %v\n", idx+1, err)
+			continue
+		}
+		if _, ok := h.hosts[host]; ok {
+			return nil, fmt.Errorf("duplicate host %s", host)
+		}
+		h.hosts[host] = strings.Split(entry[1], ",")
+		if len(entry) > 2 {
+			// Options may contain colons (IPv6 addresses), so join them back.
+			if err := h.SetOptions(host, strings.Join(entry[2:], ":")); err != nil {
+				return nil, fmt.Errorf("host %s: %w", host, err)
+			}
+		}
+	}
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Loaded %d hosts\n", len(h.hosts))
+	return h, nil
+}
+
+// CheckUser checks if user is allowed to update host. Host names are
+// compared case insensitive and in punycode, like all host names given to
+// HostsFile.
+func (h *HostsFile) CheckUser(host, user string) bool {
+	entry, ok := h.hosts[hostKey(host)]
+	if !ok {
+		return false
+	}
+	for _, u := range entry {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the references between hosts.
+func (h *HostsFile) Validate() error {
+	for _, host := range h.Hosts() {
+		options := h.Options(host)
+		if options.Via == "" {
+			continue
+		}
+		if _, ok := h.hosts[options.Via]; !ok {
+			return fmt.Errorf("host %s: unknown via host %s", host, options.Via)
+		}
+		if h.Options(options.Via).Via != "" {
+			return fmt.Errorf("host %s: via host %s is delegated itself", host, options.Via)
+		}
+	}
+	return nil
+}
+
+// Hosts returns the sorted names of all hosts.
+func (h *HostsFile) Hosts() []string {
+	names := make([]string, 0, len(h.hosts))
+	for host := range h.hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Users returns the users which are allowed to update host.
+func (h *HostsFile) Users(host string) ([]string, bool) {
+	entry, ok := h.hosts[hostKey(host)]
+	return entry, ok
+}
+
+// Set replaces the users of host, adding the host if it does not exist.
+func (h *HostsFile) Set(host string, users []string) {
+	h.hosts[hostKey(host)] = users
+}
+
+// Delete removes host.
+func (h *HostsFile) Delete(host string) {
+	host = hostKey(host)
+	delete(h.hosts, host)
+	delete(h.options, host)
+}
+
+// Options returns the options of host.
+func (h *HostsFile) Options(host string) *HostOptions {
+	if options, ok := h.options[hostKey(host)]; ok {
+		return options
+	}
+	return &HostOptions{}
+}
+
+// SetOptions parses and sets the options of host.
+func (h *HostsFile) SetOptions(host, s string) error {
+	options, err := ParseHostOptions(s)
+	if err != nil {
+		return err
+	}
+	host = hostKey(host)
+	if options.String() == "" {
+		delete(h.options, host)
+	} else {
+		h.options[host] = options
+	}
+	return nil
+}
+
+// Delegated returns the sorted names of all hosts which get their IPv6
+// address from the prefix of the via host.
+func (h *HostsFile) Delegated(via string) []string {
+	var names []string
+	via = hostKey(via)
+	for host, options := range h.options {
+		if options.Via == via {
+			names = append(names, host)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Bytes returns all hosts in hosts database format.
+func (h *HostsFile) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, host := range h.Hosts() {
+		fmt.Fprintf(&buf, "%s:%s", host, strings.Join(h.hosts[host], ","))
+		if options, ok := h.options[host]; ok {
+			fmt.Fprintf(&buf, ":%s", options)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+// WriteFile writes all hosts to fn atomically.
+func (h *HostsFile) WriteFile(fn string) error {
+	if err := WriteFileAtomic(fn, h.Bytes(), 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote %d hosts\n", len(h.hosts))
+	return nil
+}
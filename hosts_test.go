@@ -0,0 +1,190 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package mydyns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidHostname(t *testing.T) {
+	tests := []struct {
+		host  string
+		valid bool
+	}{
+		{"myhost", true},
+		{"MyHost", true},
+		{"my-host", true},
+		{"mail.myhost", true},
+		{"a.b.c", true},
+		{"123", true},
+		{"xn--mller-kva", true},
+		{"", false},
+		{"-myhost", false},
+		{"myhost-", false},
+		{"my_host", false},
+		{"my host", false},
+		{"mail..myhost", false},
+		{".myhost", false},
+		{"myhost.", false},
+		{"*.myhost", false},
+		{"müller", false},
+		{strings.Repeat("a", 63), true},
+		{strings.Repeat("a", 64), false},
+		{strings.Repeat("a.", 126) + "a", true},
+		{strings.Repeat("a.", 127), false},
+	}
+	for _, test := range tests {
+		if valid := ValidHostname(test.host); valid != test.valid {
+			t.Errorf("ValidHostname(%q) = %v, want %v", test.host, valid, test.valid)
+		}
+	}
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"myhost", "myhost"},
+		{"MyHost", "myhost"},
+		{"Mail.MyHost", "mail.myhost"},
+		{"müller", "xn--mller-kva"},
+		{"MÜLLER", "xn--mller-kva"},
+		{"xn--mller-kva", "xn--mller-kva"},
+		{"straße", "xn--strae-oqa"},
+		{"bücher.müller", "xn--bcher-kva.xn--mller-kva"},
+		{"", ""},
+		{"my_host", ""},
+		{"-myhost", ""},
+		{"mail..myhost", ""},
+		{"a b", ""},
+		{"mail.XN--MLLER-KVA", "mail.xn--mller-kva"},
+		{"bücher。müller", "xn--bcher-kva.xn--mller-kva"},
+		{"xn--invalid-", ""},
+		{"mail.xn--myhost-", ""},
+	}
+	for _, test := range tests {
+		name, err := NormalizeHostname(test.host)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("NormalizeHostname(%q) = %q, expected error", test.host, name)
+			}
+			continue
+		}
+		if err != nil || name != test.expected {
+			t.Errorf("NormalizeHostname(%q) = %q, %v, want %q", test.host, name, err, test.expected)
+		}
+	}
+}
+
+func TestUnicodeHostname(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"myhost", "myhost"},
+		{"xn--mller-kva", "müller"},
+		{"xn--bcher-kva.xn--mller-kva", "bücher.müller"},
+		{"xn--strae-oqa", "straße"},
+	}
+	for _, test := range tests {
+		if name := UnicodeHostname(test.host); name != test.expected {
+			t.Errorf("UnicodeHostname(%q) = %q, want %q", test.host, name, test.expected)
+		}
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     bool
+	}{
+		{"simple", "myhost:alice\n", false},
+		{"several users", "myhost:alice,bob\n", false},
+		{"comment", "# hosts\nmyhost:alice\n", false},
+		{"unicode", "Müller:alice\n", false},
+		{"options", "router:alice\nnas:alice:via=router,iid=::a1b2\n", false},
+		{"missing users", "myhost\n", true},
+		{"empty users", "myhost:\n", true},
+		{"duplicate", "myhost:alice\nMyHost:bob\n", true},
+		{"duplicate punycode", "müller:alice\nxn--mller-kva:bob\n", true},
+		{"invalid options", "myhost:alice:unknown\n", true},
+		{"unknown via", "nas:alice:via=router,iid=::a1b2\n", true},
+	}
+	for _, test := range tests {
+		h, err := ParseHosts(strings.NewReader(test.content))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		// Written content parses to the same hosts.
+		parsed, err := ParseHosts(strings.NewReader(string(h.Bytes())))
+		if err != nil {
+			t.Errorf("%s: written hosts do not parse: %v", test.name, err)
+			continue
+		}
+		if string(parsed.Bytes()) != string(h.Bytes()) {
+			t.Errorf("%s: round trip changed hosts: %q", test.name, parsed.Bytes())
+		}
+	}
+}
+
+func TestParseHostsSkipsInvalidNames(t *testing.T) {
+	h, err := ParseHosts(strings.NewReader("my_host:alice\nmyhost:alice\n-bad:bob\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts := h.Hosts(); len(hosts) != 1 || hosts[0] != "myhost" {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+}
+
+func TestHostsFileCheckUser(t *testing.T) {
+	h, err := ParseHosts(strings.NewReader("müller:alice,bob\nmyhost:alice\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, user string
+		allowed    bool
+	}{
+		{"myhost", "alice", true},
+		{"MyHost", "alice", true},
+		{"myhost", "bob", false},
+		{"müller", "bob", true},
+		{"MÜLLER", "alice", true},
+		{"xn--mller-kva", "alice", true},
+		{"unknown", "alice", false},
+		{"myhost", "", false},
+	}
+	for _, test := range tests {
+		if allowed := h.CheckUser(test.host, test.user); allowed != test.allowed {
+			t.Errorf("CheckUser(%q, %q) = %v, want %v", test.host, test.user, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package mydyns
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/mail"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordParse defines a regular expression to get the password and hash.
+var passwordParser, _ = regexp.Compile(`^{([A-Z]+)}([^:\n]*)$`)
+
+// disabledPrefix marks disabled users in front of their password hash.
+const disabledPrefix = "!"
+
+type HtpasswdFile struct {
+	users  map[string]string
+	emails map[string]string
+}
+
+func NewHtpasswdFile(fn string) (*HtpasswdFile, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseHtpasswd(f)
+}
+
+// ParseHtpasswd reads users in htpasswd format from r.
+func ParseHtpasswd(r io.Reader) (*HtpasswdFile, error) {
+	// htpasswd files are essentially csv files.
+	reader := csv.NewReader(r)
+	reader.Comma = ':'
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	entries, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	ht := &HtpasswdFile{
+		users:  make(map[string]string),
+		emails: make(map[string]string),
+	}
+	for idx, entry := range entries {
+		if len(entry) < 2 || entry[0] == "" {
+			return nil, fmt.Errorf("invalid entry %d: user and password required", idx+1)
+		}
+		if _, ok := ht.users[entry[0]]; ok {
+			return nil, fmt.Errorf("duplicate user %s", entry[0])
+		}
+		if !ValidEntryValue(entry[1]) {
+			return nil, fmt.Errorf("invalid entry %d: invalid password field", idx+1)
+		}
+		if !validPasswordHash(strings.TrimPrefix(entry[1], disabledPrefix)) {
+			// Keep the entry so it is written back unchanged, it never
+			// passes a password check.
+			log.Printf("Unsupported password hash for user %s, login disabled\n", entry[0])
+		}
+		ht.users[entry[0]] = entry[1]
+		// An optional third field holds the email address of the user.
+		if len(entry) > 2 && entry[2] != "" {
+			if err := ht.SetEmail(entry[0], entry[2]); err != nil {
+				return nil, fmt.Errorf("user %s: %w", entry[0], err)
+			}
+		}
+	}
+
+	log.Printf("Loaded %d users\n", len(ht.users))
+	return ht, nil
+}
+
+func (ht *HtpasswdFile) CheckPassword(user, password string) bool {
+	entry, ok := ht.users[user]
+	if !ok || strings.HasPrefix(entry, disabledPrefix) {
+		return false
+	}
+
+	if isBcryptHash(entry) {
+		return bcrypt.CompareHashAndPassword([]byte(entry), []byte(password)) == nil
+	}
+
+	// Parse password entry into hash type and value.
+	parsed := passwordParser.FindStringSubmatch(entry)
+	if len(parsed) < 3 {
+		return false
+	}
+
+	digest := newPasswordDigest(parsed[1])
+	if digest == nil {
+		return false
+	}
+
+	digest.Write([]byte(password))
+
+	parsed_bytes, _ := base64.StdEncoding.DecodeString(parsed[2])
+
+	return subtle.ConstantTimeCompare(parsed_bytes, digest.Sum(nil)) == 1
+}
+
+// newPasswordDigest returns the hash for the given password hash type or nil
+// if the type is not supported.
+func newPasswordDigest(t string) hash.Hash {
+	switch t {
+	case "SHA":
+		return sha1.New()
+	default:
+		return nil
+	}
+}
+
+// isBcryptHash checks if hash is a bcrypt hash as created by htpasswd -B.
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$")
+}
+
+// validPasswordHash checks if hash uses one of the supported hash types and
+// can be stored in the users database.
+func validPasswordHash(hash string) bool {
+	if !ValidEntryValue(hash) {
+		return false
+	}
+	if isBcryptHash(hash) {
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	}
+	parsed := passwordParser.FindStringSubmatch(hash)
+	return len(parsed) == 3 && newPasswordDigest(parsed[1]) != nil
+}
+
+// Users returns the sorted names of all users.
+func (ht *HtpasswdFile) Users() []string {
+	names := make([]string, 0, len(ht.users))
+	for user := range ht.users {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Exists checks if user is in the database.
+func (ht *HtpasswdFile) Exists(user string) bool {
+	_, ok := ht.users[user]
+	return ok
+}
+
+// SetPassword hashes password with bcrypt and sets it for user, adding the
+// user if it does not exist. Disabled users stay disabled.
+func (ht *HtpasswdFile) SetPassword(user, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return ht.SetHash(user, string(hash))
+}
+
+// SetHash sets an already hashed password for user. The hash must use one of
+// the supported hash types. Disabled users stay disabled.
+func (ht *HtpasswdFile) SetHash(user, hash string) error {
+	if !validPasswordHash(hash) {
+		return fmt.Errorf("unsupported password hash")
+	}
+	if ht.Disabled(user) {
+		hash = disabledPrefix + hash
+	}
+	ht.users[user] = hash
+	return nil
+}
+
+// Disabled checks if user exists and is disabled.
+func (ht *HtpasswdFile) Disabled(user string) bool {
+	return strings.HasPrefix(ht.users[user], disabledPrefix)
+}
+
+// SetDisabled disables or enables user. Disabled users keep their password
+// hash, but fail all password checks.
+func (ht *HtpasswdFile) SetDisabled(user string, disabled bool) {
+	entry, ok := ht.users[user]
+	if !ok {
+		return
+	}
+	entry = strings.TrimPrefix(entry, disabledPrefix)
+	if disabled {
+		entry = disabledPrefix + entry
+	}
+	ht.users[user] = entry
+}
+
+// Email returns the email address of user or an empty string.
+func (ht *HtpasswdFile) Email(user string) string {
+	return ht.emails[user]
+}
+
+// SetEmail sets the email address of user, an empty address removes it.
+func (ht *HtpasswdFile) SetEmail(user, email string) error {
+	if email == "" {
+		delete(ht.emails, user)
+		return nil
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || !ValidEntryValue(email) {
+		return fmt.Errorf("invalid email address %s", email)
+	}
+	ht.emails[user] = email
+	return nil
+}
+
+// Delete removes user.
+func (ht *HtpasswdFile) Delete(user string) {
+	delete(ht.users, user)
+	delete(ht.emails, user)
+}
+
+// Bytes returns all users in htpasswd format.
+func (ht *HtpasswdFile) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, user := range ht.Users() {
+		fmt.Fprintf(&buf, "%s:%s", user, ht.users[user])
+		if email, ok := ht.emails[user]; ok {
+			fmt.Fprintf(&buf, ":%s", email)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+// WriteFile writes all users to fn atomically.
+func (ht *HtpasswdFile) WriteFile(fn string) error {
+	if err := WriteFileAtomic(fn, ht.Bytes(), 0640); err != nil {
+		return err
+	}
+	log.Printf("Wrote %d users\n", len(ht.users))
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package mydyns
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, content string) string {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "db")
+	if err := ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestNewHtpasswdFile(t *testing.T) {
+	// Hashes of "secret".
+	const sha = "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+	const bcrypt = "$2a$04$/JslmClptxHgu3PFZBgt6OlIyUXItUZhoXWARXY17q0rp07vFYnCm"
+	tests := []struct {
+		name    string
+		content string
+		err     bool
+		checks  map[string]bool
+	}{
+		{"sha", "alice:" + sha + "\n", false, map[string]bool{"alice": true}},
+		{"bcrypt", "alice:" + bcrypt + "\n", false, map[string]bool{"alice": true}},
+		{"disabled", "alice:!" + sha + "\n", false, map[string]bool{"alice": false}},
+		{"comment", "# users\nalice:" + sha + "\n", false, map[string]bool{"alice": true}},
+		{"email", "alice:" + sha + ":alice@example.com\n", false, map[string]bool{"alice": true}},
+		{"unsupported hash", "alice:$apr1$abc$def\nbob:" + sha + "\n", false, map[string]bool{"alice": false, "bob": true}},
+		{"plain password", "alice:secret\nbob:" + sha + "\n", false, map[string]bool{"alice": false, "bob": true}},
+		{"missing password", "alice\n", true, nil},
+		{"duplicate", "alice:" + sha + "\nalice:" + sha + "\n", true, nil},
+		{"invalid email", "alice:" + sha + ":nomail\n", true, nil},
+	}
+	for _, test := range tests {
+		ht, err := NewHtpasswdFile(writeTestFile(t, test.content))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		for user, ok := range test.checks {
+			if !ht.Exists(user) {
+				t.Errorf("%s: user %s not loaded", test.name, user)
+			}
+			if ht.CheckPassword(user, "secret") != ok {
+				t.Errorf("%s: password check for %s should be %v", test.name, user, ok)
+			}
+		}
+	}
+}
+
+func TestHtpasswdFileKeepsUnsupportedHash(t *testing.T) {
+	fn := writeTestFile(t, "alice:$apr1$abc$def\n")
+	ht, err := NewHtpasswdFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ht.WriteFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "alice:$apr1$abc$def\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
+
+func TestValidPasswordHash(t *testing.T) {
+	tests := []struct {
+		hash  string
+		valid bool
+	}{
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", true},
+		{"$2a$04$/JslmClptxHgu3PFZBgt6OlIyUXItUZhoXWARXY17q0rp07vFYnCm", true},
+		{"$2y$04$/JslmClptxHgu3PFZBgt6OlIyUXItUZhoXWARXY17q0rp07vFYnCm", true},
+		{"$2a$04$short", false},
+		{"$apr1$abc$def", false},
+		{"{MD5}abc", false},
+		{"{sha}abc", false},
+		{"secret", false},
+		{"", false},
+		{"x{SHA}abc", false},
+		{"{SHA}abc:evil@example.com", false},
+		{"{SHA}abc\nmallory:{SHA}abc", false},
+		{"{SHA}abc,def", false},
+		{" {SHA}abc", false},
+		{"!{SHA}abc", false},
+	}
+	for _, test := range tests {
+		if valid := validPasswordHash(test.hash); valid != test.valid {
+			t.Errorf("validPasswordHash(%q) = %v, want %v", test.hash, valid, test.valid)
+		}
+	}
+}
+
+func TestHtpasswdFileSetHash(t *testing.T) {
+	ht, err := ParseHtpasswd(strings.NewReader("alice:!{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ht.SetHash("bob", "{SHA}abc\nmallory:{SHA}abc"); err == nil {
+		t.Error("expected error for hash with newline")
+	}
+	if err := ht.SetHash("alice", "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="); err != nil {
+		t.Fatal(err)
+	}
+	if !ht.Disabled("alice") {
+		t.Error("alice should stay disabled")
+	}
+	parsed, err := ParseHtpasswd(bytes.NewReader(ht.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users := parsed.Users(); len(users) != 1 || users[0] != "alice" || !parsed.Disabled("alice") {
+		t.Errorf("unexpected users after round trip: %v", users)
+	}
+}
+
+func TestHtpasswdFileSetPassword(t *testing.T) {
+	ht, err := ParseHtpasswd(strings.NewReader("alice:!{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if err = ht.SetPassword(user, "changed"); err != nil {
+			t.Fatal(err)
+		}
+		if hash := strings.TrimPrefix(ht.users[user], disabledPrefix); !isBcryptHash(hash) {
+			t.Errorf("%s: expected bcrypt hash, got %s", user, hash)
+		}
+	}
+	if !ht.Disabled("alice") {
+		t.Error("alice should stay disabled")
+	}
+	if !ht.CheckPassword("bob", "changed") || ht.CheckPassword("bob", "secret") {
+		t.Error("unexpected password check result for bob")
+	}
+}
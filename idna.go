@@ -0,0 +1,60 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package mydyns
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// hostnameProfile converts internationalized host names according to the
+// UTS #46 processing of IDNA 2008, without the transitional mappings, so
+// names like straße keep their own punycode name.
+var hostnameProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.Transitional(false),
+)
+
+// ASCIIHostname returns the punycode form of host as used in DNS, mapping
+// Unicode names and upper case letters to their lower case form.
+func ASCIIHostname(host string) (string, error) {
+	return hostnameProfile.ToASCII(host)
+}
+
+// UnicodeHostname returns the Unicode form of host for display. Names which
+// cannot be converted are returned unchanged.
+func UnicodeHostname(host string) string {
+	unicode, err := hostnameProfile.ToUnicode(host)
+	if err != nil {
+		return host
+	}
+	return unicode
+}
+
+// hostKey returns the name under which host is stored, accepting Unicode
+// and mixed case names for the stored punycode names.
+func hostKey(host string) string {
+	if name, err := NormalizeHostname(host); err == nil {
+		return name
+	}
+	return strings.ToLower(host)
+}
@@ -17,14 +17,20 @@ with this program; if not, write to the Free Software Foundation, Inc.,
 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
 */
 
-package main
+package mydyns
 
 import (
+	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/csv"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -39,8 +45,13 @@ func NewSecurityFile(fn string) (*SecurityFile, error) {
 	}
 	defer f.Close()
 
+	return ParseSecurity(f)
+}
+
+// ParseSecurity reads security codes from r.
+func ParseSecurity(r io.Reader) (*SecurityFile, error) {
 	// security files are essentially csv files.
-	reader := csv.NewReader(f)
+	reader := csv.NewReader(r)
 	reader.Comma = ':'
 	reader.Comment = '#'
 	reader.TrimLeadingSpace = true
@@ -53,7 +64,10 @@ func NewSecurityFile(fn string) (*SecurityFile, error) {
 	s := &SecurityFile{
 		security: make(map[string][]byte),
 	}
-	for _, entry := range entries {
+	for idx, entry := range entries {
+		if len(entry) < 2 || entry[0] == "" {
+			return nil, fmt.Errorf("invalid entry %d: user and security code required", idx+1)
+		}
 		s.security[entry[0]] = []byte(strings.Trim(entry[1], " "))
 	}
 
@@ -83,3 +97,57 @@ func (s *SecurityFile) Secret(user string) []byte {
 	mac.Write([]byte(user))
 	return mac.Sum(nil)
 }
+
+// Users returns the sorted names of all users with a security code.
+func (s *SecurityFile) Users() []string {
+	names := make([]string, 0, len(s.security))
+	for user := range s.security {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Code returns the security code of user.
+func (s *SecurityFile) Code(user string) (string, bool) {
+	entry, ok := s.security[user]
+	return string(entry), ok
+}
+
+// Set sets the security code of user, which invalidates all tokens issued
+// with the previous code.
+func (s *SecurityFile) Set(user, code string) {
+	s.security[user] = []byte(code)
+}
+
+// Delete removes the security code of user.
+func (s *SecurityFile) Delete(user string) {
+	delete(s.security, user)
+}
+
+// Bytes returns all security codes in security database format.
+func (s *SecurityFile) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, user := range s.Users() {
+		fmt.Fprintf(&buf, "%s:%s\n", user, s.security[user])
+	}
+	return buf.Bytes()
+}
+
+// WriteFile writes all security codes to fn atomically.
+func (s *SecurityFile) WriteFile(fn string) error {
+	if err := WriteFileAtomic(fn, s.Bytes(), 0640); err != nil {
+		return err
+	}
+	log.Printf("Wrote %d security entries\n", len(s.security))
+	return nil
+}
+
+// NewSecurityCode generates a random security code.
+func NewSecurityCode() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
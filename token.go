@@ -0,0 +1,61 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package mydyns
+
+// TokenName is the name used when encoding update tokens.
+const TokenName = "u"
+
+// TokenData defines the data to encode into tokens. Tokens for a single host
+// only set Host, tokens for several hosts only set Hosts.
+type TokenData struct {
+	Host     string
+	User     string
+	Security []byte
+	Hosts    []string
+}
+
+// NewTokenData returns the token data for user to update hosts.
+func NewTokenData(hosts []string, user string, security []byte) *TokenData {
+	data := &TokenData{
+		User:     user,
+		Security: security,
+	}
+	if len(hosts) == 1 {
+		data.Host = hosts[0]
+	} else {
+		data.Hosts = hosts
+	}
+	return data
+}
+
+// Hostnames returns the names of all hosts of the token, normalized to the
+// names under which hosts are stored. Tokens may have been created before
+// names were normalized.
+func (data *TokenData) Hostnames() []string {
+	names := data.Hosts
+	if len(names) == 0 {
+		names = []string{data.Host}
+	}
+	hostnames := make([]string, len(names))
+	for idx, name := range names {
+		hostnames[idx] = hostKey(name)
+	}
+	return hostnames
+}
@@ -0,0 +1,44 @@
+/*
+Mydyns - run your own dynamic DNS zone
+Copyright (C) 2015  Simon Eisenmann
+
+This program is free software; you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation; either version 2 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along
+with this program; if not, write to the Free Software Foundation, Inc.,
+51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package mydyns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenDataHostnames(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     *TokenData
+		expected string
+	}{
+		{"single", NewTokenData([]string{"home"}, "alice", nil), "home"},
+		{"several", NewTokenData([]string{"home", "cabin"}, "alice", nil), "home,cabin"},
+		{"mixed case", &TokenData{Host: "HOME"}, "home"},
+		{"unicode", &TokenData{Hosts: []string{"München", "Home"}}, "xn--mnchen-3ya,home"},
+		{"invalid", &TokenData{Host: "My_Host"}, "my_host"},
+	}
+	for _, test := range tests {
+		if hostnames := strings.Join(test.data.Hostnames(), ","); hostnames != test.expected {
+			t.Errorf("%s: got %s, want %s", test.name, hostnames, test.expected)
+		}
+	}
+}